@@ -3,11 +3,32 @@ package main
 import (
 	commands "BTCPrice/Client/Commands"
 	"log"
+	"os"
 )
 
 func main() {
 	commands.RootCmd.PersistentFlags().StringVar(&commands.StartTime, "start", "", "Start time for the subscription (format: 2006-01-02T15:04:05Z07:00)")
-	commands.RootCmd.AddCommand(commands.UsdCmd, commands.EurCmd, commands.AllCmd)
+	commands.RootCmd.PersistentFlags().StringToInt64Var(&commands.ResumeAfter, "resume-after", nil, "Resume after the sequence number of each currency's last price, e.g. USD=42")
+	commands.RootCmd.PersistentFlags().StringVar(&commands.Asset, "asset", "BTC", "Crypto asset to price, e.g. BTC or ETH")
+	commands.RootCmd.PersistentFlags().DurationVar(&commands.MinInterval, "min-interval", 0, "Receive at most one price per currency in this interval, e.g. 30s")
+	commands.RootCmd.PersistentFlags().Float64Var(&commands.MinChange, "min-change", 0, "Only receive prices that moved at least this much")
+	commands.RootCmd.PersistentFlags().Float64Var(&commands.MinChangePercent, "min-change-percent", 0, "Only receive prices that moved at least this many percent")
+	commands.RootCmd.PersistentFlags().StringVar(&commands.APIKey, "api-key", os.Getenv("BTCPRICE_API_KEY"), "API key to authenticate with (env BTCPRICE_API_KEY)")
+	commands.RootCmd.PersistentFlags().StringVar(&commands.Token, "token", os.Getenv("BTCPRICE_TOKEN"), "JWT to authenticate with (env BTCPRICE_TOKEN)")
+	commands.RootCmd.PersistentFlags().StringVar(&commands.CAFile, "ca", "", "CA bundle to verify the server certificate with, enables TLS")
+	commands.RootCmd.PersistentFlags().StringVar(&commands.CertFile, "cert", "", "Client certificate for mutual TLS")
+	commands.RootCmd.PersistentFlags().StringVar(&commands.KeyFile, "key", "", "Client private key for mutual TLS")
+	commands.AlertAddCmd.Flags().Float64Var(&commands.Above, "above", 0, "Trigger when the price rises to this level")
+	commands.AlertAddCmd.Flags().Float64Var(&commands.Below, "below", 0, "Trigger when the price falls to this level")
+	commands.AlertAddCmd.Flags().Float64Var(&commands.ChangePercent, "change", 0, "Trigger when the price moves by this many percent within --window")
+	commands.AlertAddCmd.Flags().Int32Var(&commands.WindowMinutes, "window", 60, "Window of --change in minutes")
+	commands.AlertCmd.AddCommand(commands.AlertAddCmd, commands.AlertListCmd, commands.AlertDeleteCmd, commands.AlertWatchCmd)
+	commands.WebhookAddCmd.Flags().StringSliceVar(&commands.WebhookEvents, "events", []string{"tick"}, "Events to deliver: tick, alert or both")
+	commands.WebhookAddCmd.Flags().StringSliceVar(&commands.WebhookAssets, "assets", nil, "Only deliver these assets (default all)")
+	commands.WebhookAddCmd.Flags().StringSliceVar(&commands.WebhookCurrencies, "currencies", nil, "Only deliver these currencies (default all)")
+	commands.WebhookAddCmd.Flags().StringVar(&commands.WebhookSecret, "secret", "", "Signing secret (default generated)")
+	commands.WebhookCmd.AddCommand(commands.WebhookAddCmd, commands.WebhookListCmd, commands.WebhookDeleteCmd, commands.WebhookReplayCmd)
+	commands.RootCmd.AddCommand(commands.UsdCmd, commands.EurCmd, commands.AllCmd, commands.PriceCmd, commands.CurrenciesCmd, commands.AlertCmd, commands.WebhookCmd)
 	if err := commands.RootCmd.Execute(); err != nil {
 		log.Fatalf("Error while executing root command: %v", err)
 	}
@@ -0,0 +1,150 @@
+package commands
+
+import (
+	pricepb "BTCPrice/protofiles"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// Alert condition flags
+var (
+	Above         float64
+	Below         float64
+	ChangePercent float64
+	WindowMinutes int32
+)
+
+var AlertCmd = &cobra.Command{
+	Use:   "alert",
+	Short: "Manage price alerts",
+}
+
+var AlertAddCmd = &cobra.Command{
+	Use:   "add CURRENCY",
+	Short: "Create an alert, e.g. alert add USD --above 70000 or alert add EUR --change 5 --window 60",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		req := &pricepb.CreateAlertRequest{Asset: Asset, Currency: args[0]}
+		switch {
+		case Above > 0:
+			req.Condition, req.Threshold = pricepb.AlertCondition_PRICE_ABOVE, Above
+		case Below > 0:
+			req.Condition, req.Threshold = pricepb.AlertCondition_PRICE_BELOW, Below
+		case ChangePercent > 0:
+			req.Condition, req.Percent, req.WindowMinutes = pricepb.AlertCondition_PERCENT_CHANGE, ChangePercent, WindowMinutes
+		default:
+			log.Fatal("One of --above, --below or --change is required")
+		}
+		createAlert(req)
+	},
+}
+
+var AlertListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List your alerts",
+	Run: func(cmd *cobra.Command, args []string) {
+		listAlerts()
+	},
+}
+
+var AlertDeleteCmd = &cobra.Command{
+	Use:   "delete ID",
+	Short: "Delete an alert",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		deleteAlert(args[0])
+	},
+}
+
+var AlertWatchCmd = &cobra.Command{
+	Use:   "watch",
+	Short: "Print your alerts as they trigger, after those triggered since --start",
+	Run: func(cmd *cobra.Command, args []string) {
+		watchAlerts(StartTime)
+	},
+}
+
+func createAlert(req *pricepb.CreateAlertRequest) {
+	cc := dial()
+	defer cc.Close()
+
+	c := pricepb.NewPriceServiceClient(cc)
+	alert, err := c.CreateAlert(withCredentials(context.Background()), req)
+	if err != nil {
+		log.Fatalf("Error while calling CreateAlert: %s", describeError(err))
+	}
+	fmt.Printf("Created alert %s\n", alert.GetId())
+}
+
+func listAlerts() {
+	cc := dial()
+	defer cc.Close()
+
+	c := pricepb.NewPriceServiceClient(cc)
+	res, err := c.ListAlerts(withCredentials(context.Background()), &pricepb.ListAlertsRequest{})
+	if err != nil {
+		log.Fatalf("Error while calling ListAlerts: %s", describeError(err))
+	}
+
+	for _, alert := range res.GetAlerts() {
+		triggered := "never triggered"
+		if alert.GetLastTriggeredAt() != "" {
+			triggered = fmt.Sprintf("last triggered %s at %v", alert.GetLastTriggeredAt(), alert.GetLastTriggeredPrice())
+		}
+		fmt.Printf("%s\t%s/%s\t%s\t%s\n", alert.GetId(), alert.GetAsset(), alert.GetCurrency(), describeCondition(alert), triggered)
+	}
+}
+
+func deleteAlert(id string) {
+	cc := dial()
+	defer cc.Close()
+
+	c := pricepb.NewPriceServiceClient(cc)
+	if _, err := c.DeleteAlert(withCredentials(context.Background()), &pricepb.DeleteAlertRequest{Id: id}); err != nil {
+		log.Fatalf("Error while calling DeleteAlert: %s", describeError(err))
+	}
+	fmt.Printf("Deleted alert %s\n", id)
+}
+
+func watchAlerts(startTime string) {
+	cc := dial()
+	defer cc.Close()
+
+	c := pricepb.NewPriceServiceClient(cc)
+	stream, err := c.WatchAlerts(withCredentials(context.Background()), &pricepb.WatchAlertsRequest{StartTime: startTime})
+	if err != nil {
+		log.Fatalf("Error while calling WatchAlerts: %s", describeError(err))
+	}
+
+	for {
+		event, err := stream.Recv()
+		if err == io.EOF {
+			log.Fatal("The stream has ended")
+		}
+		if err != nil {
+			log.Fatalf("Error while reading stream: %s", describeError(err))
+		}
+
+		alert := event.GetAlert()
+		log.Printf("Alert %s triggered: %s/%s %s, price %v at %s", alert.GetId(), alert.GetAsset(), alert.GetCurrency(),
+			describeCondition(alert), event.GetPrice(), event.GetTimedate())
+	}
+}
+
+// Describe the condition of an alert, e.g. "above 70000"
+func describeCondition(alert *pricepb.Alert) string {
+	switch alert.GetCondition() {
+	case pricepb.AlertCondition_PRICE_ABOVE:
+		return fmt.Sprintf("above %v", alert.GetThreshold())
+	case pricepb.AlertCondition_PRICE_BELOW:
+		return fmt.Sprintf("below %v", alert.GetThreshold())
+	case pricepb.AlertCondition_PERCENT_CHANGE:
+		return fmt.Sprintf("moves %v%% in %d minutes", alert.GetPercent(), alert.GetWindowMinutes())
+	}
+	return strings.ToLower(alert.GetCondition().String())
+}
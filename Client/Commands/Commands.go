@@ -3,12 +3,25 @@ package commands
 import (
 	pricepb "BTCPrice/protofiles"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"io"
 	"log"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 const (
@@ -22,6 +35,32 @@ var RootCmd = &cobra.Command{
 
 var StartTime string
 
+// Sequence numbers of the last prices received, to resume each currency after
+var ResumeAfter map[string]int64
+
+// Asset to price, BTC by default
+var Asset string
+
+// Conflation options of subscriptions
+var (
+	MinInterval      time.Duration
+	MinChange        float64
+	MinChangePercent float64
+)
+
+// Credentials sent with every call
+var (
+	APIKey string
+	Token  string
+)
+
+// TLS settings; the connection is insecure when none are set
+var (
+	CAFile   string
+	CertFile string
+	KeyFile  string
+)
+
 var UsdCmd = &cobra.Command{
 	Use:   "usd",
 	Short: "Get BTC price in USD",
@@ -45,13 +84,39 @@ var AllCmd = &cobra.Command{
 	},
 }
 
-func runClient(currencies []string, startTime string) {
+var PriceCmd = &cobra.Command{
+	Use:   "price CURRENCY...",
+	Short: "Get the asset price in the given currencies, e.g. price GBP JPY",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runClient(args, StartTime)
+	},
+}
+
+var CurrenciesCmd = &cobra.Command{
+	Use:   "currencies",
+	Short: "List the available currencies",
+	Run: func(cmd *cobra.Command, args []string) {
+		listCurrencies()
+	},
+}
+
+// Connect to the server, retrying a few times
+func dial() *grpc.ClientConn {
 	var cc *grpc.ClientConn
 	var err error
 
+	// Carry the trace context to the server in gRPC metadata
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	creds, err := transportCredentials()
+	if err != nil {
+		log.Fatalf("Invalid TLS settings: %v", err)
+	}
+
 	// Retry the connection up to 5 times
 	for i := 0; i < Retries; i++ {
-		cc, err = grpc.Dial("localhost:50051", grpc.WithInsecure())
+		cc, err = grpc.Dial("localhost:50051", grpc.WithTransportCredentials(creds), grpc.WithStatsHandler(otelgrpc.NewClientHandler()))
 		if err == nil {
 			break
 		}
@@ -65,18 +130,61 @@ func runClient(currencies []string, startTime string) {
 		log.Fatalf("Could not connect: %v", err)
 	}
 
+	return cc
+}
+
+func listCurrencies() {
+	cc := dial()
+	defer cc.Close()
+
+	c := pricepb.NewPriceServiceClient(cc)
+	res, err := c.ListCurrencies(withCredentials(context.Background()), &pricepb.ListCurrenciesRequest{Asset: Asset})
+	if err != nil {
+		log.Fatalf("Error while calling ListCurrencies: %s", describeError(err))
+	}
+
+	for _, currency := range res.GetCurrencies() {
+		source := "direct"
+		if currency.GetConverted() {
+			source = "converted"
+		}
+		fmt.Printf("%s\t%s\t%d decimals\t%s\n", currency.GetCode(), currency.GetName(), currency.GetPrecision(), source)
+	}
+	fmt.Printf("Assets: %s\n", strings.Join(res.GetAssets(), ", "))
+}
+
+func runClient(currencies []string, startTime string) {
+	cc := dial()
 	defer cc.Close()
 
 	c := pricepb.NewPriceServiceClient(cc)
 
-	// If no start time is provided, use the current time
-	if startTime == "" {
+	// If no start time is provided, use the current time, unless resuming
+	if startTime == "" && len(ResumeAfter) == 0 {
 		startTime = time.Now().Format(time.RFC3339)
 	}
+	var resumeAfter map[string]uint64
+	for currency, sequence := range ResumeAfter {
+		if sequence <= 0 {
+			log.Fatalf("Invalid --resume-after sequence for %s: %d", currency, sequence)
+		}
+		if resumeAfter == nil {
+			resumeAfter = map[string]uint64{}
+		}
+		resumeAfter[currency] = uint64(sequence)
+	}
 
-	stream, err := c.Subscribe(context.Background(), &pricepb.SubscribeRequest{Currencies: currencies, StartTime: startTime})
+	stream, err := c.Subscribe(withCredentials(context.Background()), &pricepb.SubscribeRequest{
+		Asset:              Asset,
+		Currencies:         currencies,
+		StartTime:          startTime,
+		ResumeAfter:        resumeAfter,
+		MinIntervalSeconds: int32(MinInterval.Seconds()),
+		MinChange:          MinChange,
+		MinChangePercent:   MinChangePercent,
+	})
 	if err != nil {
-		log.Fatalf("Error while calling Subscribe: %v", err)
+		log.Fatalf("Error while calling Subscribe: %s", describeError(err))
 	}
 
 	for {
@@ -86,9 +194,68 @@ func runClient(currencies []string, startTime string) {
 			log.Fatal("The stream has ended")
 		}
 		if err != nil {
-			log.Fatalf("Error while reading stream: %v", err)
+			log.Fatalf("Error while reading stream: %s", describeError(err))
+		}
+		if msg.GetHeartbeat() {
+			continue
 		}
 
 		log.Printf("Received a new price update: %v", msg)
 	}
 }
+
+// Attach the configured credentials to the outgoing metadata
+func withCredentials(ctx context.Context) context.Context {
+	if APIKey != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "x-api-key", APIKey)
+	}
+	if Token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+Token)
+	}
+	return ctx
+}
+
+// Build the transport credentials from the TLS flags
+func transportCredentials() (credentials.TransportCredentials, error) {
+	if CAFile == "" && CertFile == "" && KeyFile == "" {
+		return insecure.NewCredentials(), nil
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if CAFile != "" {
+		pem, err := os.ReadFile(CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle")
+		}
+	}
+	if CertFile != "" || KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(CertFile, KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return credentials.NewTLS(config), nil
+}
+
+// Describe a status error, including what to fix or when to retry
+func describeError(err error) string {
+	st := status.Convert(err)
+	description := fmt.Sprintf("%s: %s", st.Code(), st.Message())
+	for _, detail := range st.Details() {
+		switch detail := detail.(type) {
+		case *errdetails.RetryInfo:
+			description += fmt.Sprintf(" (retry in %s)", detail.GetRetryDelay().AsDuration())
+		case *errdetails.BadRequest:
+			for _, violation := range detail.GetFieldViolations() {
+				description += fmt.Sprintf("\n  %s: %s", violation.GetField(), violation.GetDescription())
+			}
+		}
+	}
+	return description
+}
@@ -0,0 +1,133 @@
+package commands
+
+import (
+	pricepb "BTCPrice/protofiles"
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// Webhook flags
+var (
+	WebhookEvents     []string
+	WebhookAssets     []string
+	WebhookCurrencies []string
+	WebhookSecret     string
+)
+
+var WebhookCmd = &cobra.Command{
+	Use:   "webhook",
+	Short: "Manage webhooks",
+}
+
+var WebhookAddCmd = &cobra.Command{
+	Use:   "add URL",
+	Short: "Register a webhook, e.g. webhook add https://example.com/hook --events tick --currencies USD",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		req := &pricepb.CreateWebhookRequest{Url: args[0], Assets: WebhookAssets, Currencies: WebhookCurrencies, Secret: WebhookSecret}
+		for _, event := range WebhookEvents {
+			switch strings.ToLower(event) {
+			case "tick":
+				req.Events = append(req.Events, pricepb.WebhookEvent_WEBHOOK_EVENT_TICK)
+			case "alert":
+				req.Events = append(req.Events, pricepb.WebhookEvent_WEBHOOK_EVENT_ALERT)
+			default:
+				log.Fatalf("Unknown event %q, expected tick or alert", event)
+			}
+		}
+		createWebhook(req)
+	},
+}
+
+var WebhookListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List your webhooks",
+	Run: func(cmd *cobra.Command, args []string) {
+		listWebhooks()
+	},
+}
+
+var WebhookDeleteCmd = &cobra.Command{
+	Use:   "delete ID",
+	Short: "Delete a webhook",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		deleteWebhook(args[0])
+	},
+}
+
+var WebhookReplayCmd = &cobra.Command{
+	Use:   "replay ID",
+	Short: "Redeliver the payloads a webhook failed to receive",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		replayWebhook(args[0])
+	},
+}
+
+func createWebhook(req *pricepb.CreateWebhookRequest) {
+	cc := dial()
+	defer cc.Close()
+
+	c := pricepb.NewPriceServiceClient(cc)
+	webhook, err := c.CreateWebhook(withCredentials(context.Background()), req)
+	if err != nil {
+		log.Fatalf("Error while calling CreateWebhook: %s", describeError(err))
+	}
+	fmt.Printf("Created webhook %s\nSigning secret: %s\n", webhook.GetId(), webhook.GetSecret())
+}
+
+func listWebhooks() {
+	cc := dial()
+	defer cc.Close()
+
+	c := pricepb.NewPriceServiceClient(cc)
+	res, err := c.ListWebhooks(withCredentials(context.Background()), &pricepb.ListWebhooksRequest{})
+	if err != nil {
+		log.Fatalf("Error while calling ListWebhooks: %s", describeError(err))
+	}
+
+	for _, webhook := range res.GetWebhooks() {
+		var events []string
+		for _, event := range webhook.GetEvents() {
+			events = append(events, strings.ToLower(strings.TrimPrefix(event.String(), "WEBHOOK_EVENT_")))
+		}
+		fmt.Printf("%s\t%s\t%s\tassets: %s\tcurrencies: %s\t%d dead letters\n", webhook.GetId(), webhook.GetUrl(),
+			strings.Join(events, ","), describeFilter(webhook.GetAssets()), describeFilter(webhook.GetCurrencies()), webhook.GetDeadLetters())
+	}
+}
+
+func deleteWebhook(id string) {
+	cc := dial()
+	defer cc.Close()
+
+	c := pricepb.NewPriceServiceClient(cc)
+	if _, err := c.DeleteWebhook(withCredentials(context.Background()), &pricepb.DeleteWebhookRequest{Id: id}); err != nil {
+		log.Fatalf("Error while calling DeleteWebhook: %s", describeError(err))
+	}
+	fmt.Printf("Deleted webhook %s\n", id)
+}
+
+func replayWebhook(id string) {
+	cc := dial()
+	defer cc.Close()
+
+	c := pricepb.NewPriceServiceClient(cc)
+	res, err := c.ReplayWebhook(withCredentials(context.Background()), &pricepb.ReplayWebhookRequest{Id: id})
+	if err != nil {
+		log.Fatalf("Error while calling ReplayWebhook: %s", describeError(err))
+	}
+	fmt.Printf("Delivered %d payloads, %d failed again\n", res.GetDelivered(), res.GetFailed())
+}
+
+// Describe a webhook filter, where empty means everything
+func describeFilter(values []string) string {
+	if len(values) == 0 {
+		return "all"
+	}
+	return strings.Join(values, ",")
+}
@@ -0,0 +1,92 @@
+package Server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/go-redis/redis/v8"
+	"google.golang.org/grpc/metadata"
+)
+
+const apiKeysRedisKey = "apikeys"
+
+// KeyStore resolves an API key to the ID of its owner
+type KeyStore interface {
+	Lookup(ctx context.Context, key string) (string, bool, error)
+}
+
+// FileKeyStore holds API keys loaded from a JSON file mapping each key to its owner
+type FileKeyStore struct {
+	keys map[string]string
+}
+
+// Load the API keys from a JSON file
+func NewFileKeyStore(path string) (*FileKeyStore, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read API keys file: %v", err)
+	}
+
+	keys := map[string]string{}
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("failed to parse API keys file: %v", err)
+	}
+
+	return &FileKeyStore{keys: keys}, nil
+}
+
+func (store *FileKeyStore) Lookup(ctx context.Context, key string) (string, bool, error) {
+	owner, ok := store.keys[key]
+	return owner, ok, nil
+}
+
+// RedisKeyStore looks API keys up in the "apikeys" Redis hash
+type RedisKeyStore struct {
+	RedisClient *redis.Client
+}
+
+// Create a new Redis backed key store
+func NewRedisKeyStore(client *redis.Client) *RedisKeyStore {
+	return &RedisKeyStore{RedisClient: client}
+}
+
+func (store *RedisKeyStore) Lookup(ctx context.Context, key string) (string, bool, error) {
+	owner, err := store.RedisClient.HGet(ctx, apiKeysRedisKey, key).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, Unavailable("look up API key", err, defaultRetryAfter)
+	}
+	return owner, true, nil
+}
+
+// APIKeyAuthenticator authenticates callers by the x-api-key header
+type APIKeyAuthenticator struct {
+	Store KeyStore
+}
+
+// Create a new API key authenticator
+func NewAPIKeyAuthenticator(store KeyStore) *APIKeyAuthenticator {
+	return &APIKeyAuthenticator{Store: store}
+}
+
+func (auth *APIKeyAuthenticator) Authenticate(ctx context.Context, md metadata.MD) (*Principal, error) {
+	values := md.Get(apiKeyHeader)
+	if len(values) == 0 || values[0] == "" {
+		return nil, ErrNoCredentials
+	}
+
+	owner, ok, err := auth.Store.Lookup(ctx, values[0])
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("unknown API key")
+	}
+
+	return &Principal{ID: owner, Method: "apikey"}, nil
+}
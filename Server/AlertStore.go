@@ -0,0 +1,229 @@
+package Server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	alertsRedisKey = "alerts"
+	// Triggered alerts of a client are kept in the sorted set "alerts:events:<client>"
+	alertEventsRedisKey = "alerts:events:"
+	// Triggered alerts kept per client
+	maxStoredAlertEvents = 1000
+)
+
+// AlertStore persists alerts and the alerts they triggered, so both survive restarts
+type AlertStore interface {
+	SaveAlert(ctx context.Context, alert *Alert) error
+	// UpdateAlert saves the alert only if it was not deleted in the meantime
+	UpdateAlert(ctx context.Context, alert *Alert) error
+	DeleteAlert(ctx context.Context, id string) error
+	// LoadAlert returns the alert with the id, or nil when there is none
+	LoadAlert(ctx context.Context, id string) (*Alert, error)
+	// LoadAlerts returns every alert of every client
+	LoadAlerts(ctx context.Context) ([]*Alert, error)
+	SaveEvent(ctx context.Context, event *AlertEvent) error
+	// LoadEvents returns the events of the owner since the time, oldest first
+	LoadEvents(ctx context.Context, owner string, since time.Time) ([]*AlertEvent, error)
+}
+
+// RedisAlertStore keeps alerts in the "alerts" Redis hash and their events in a sorted set per client
+type RedisAlertStore struct {
+	RedisClient *redis.Client
+}
+
+func (store *RedisAlertStore) SaveAlert(ctx context.Context, alert *Alert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return Internal("save alert", err)
+	}
+	if err := store.RedisClient.HSet(ctx, alertsRedisKey, alert.ID, body).Err(); err != nil {
+		return Unavailable("save alert", err, defaultRetryAfter)
+	}
+	return nil
+}
+
+// Set the field of the hash only if it exists
+var updateFieldScript = redis.NewScript(`
+if redis.call("HEXISTS", KEYS[1], ARGV[1]) == 1 then
+	return redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+end
+return 0
+`)
+
+func (store *RedisAlertStore) UpdateAlert(ctx context.Context, alert *Alert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return Internal("update alert", err)
+	}
+	if err := updateFieldScript.Run(ctx, store.RedisClient, []string{alertsRedisKey}, alert.ID, body).Err(); err != nil {
+		return Unavailable("update alert", err, defaultRetryAfter)
+	}
+	return nil
+}
+
+func (store *RedisAlertStore) DeleteAlert(ctx context.Context, id string) error {
+	if err := store.RedisClient.HDel(ctx, alertsRedisKey, id).Err(); err != nil {
+		return Unavailable("delete alert", err, defaultRetryAfter)
+	}
+	return nil
+}
+
+func (store *RedisAlertStore) LoadAlert(ctx context.Context, id string) (*Alert, error) {
+	value, err := store.RedisClient.HGet(ctx, alertsRedisKey, id).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, Unavailable("load alert", err, defaultRetryAfter)
+	}
+	alert := &Alert{}
+	if err := json.Unmarshal([]byte(value), alert); err != nil {
+		return nil, Internal("load alert", fmt.Errorf("failed to unmarshal alert %s: %v", id, err))
+	}
+	return alert, nil
+}
+
+func (store *RedisAlertStore) LoadAlerts(ctx context.Context) ([]*Alert, error) {
+	values, err := store.RedisClient.HGetAll(ctx, alertsRedisKey).Result()
+	if err != nil {
+		return nil, Unavailable("load alerts", err, defaultRetryAfter)
+	}
+
+	alerts := make([]*Alert, 0, len(values))
+	for id, value := range values {
+		alert := &Alert{}
+		if err := json.Unmarshal([]byte(value), alert); err != nil {
+			return nil, Internal("load alerts", fmt.Errorf("failed to unmarshal alert %s: %v", id, err))
+		}
+		alerts = append(alerts, alert)
+	}
+	return alerts, nil
+}
+
+func (store *RedisAlertStore) SaveEvent(ctx context.Context, event *AlertEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return Internal("save alert event", err)
+	}
+
+	key := alertEventsRedisKey + event.Alert.Owner
+	pipe := store.RedisClient.TxPipeline()
+	pipe.ZAdd(ctx, key, &redis.Z{Score: float64(event.Time.UnixNano()), Member: body})
+	// Drop the oldest events beyond the limit
+	pipe.ZRemRangeByRank(ctx, key, 0, -maxStoredAlertEvents-1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return Unavailable("save alert event", err, defaultRetryAfter)
+	}
+	return nil
+}
+
+func (store *RedisAlertStore) LoadEvents(ctx context.Context, owner string, since time.Time) ([]*AlertEvent, error) {
+	values, err := store.RedisClient.ZRangeByScore(ctx, alertEventsRedisKey+owner, &redis.ZRangeBy{
+		Min: strconv.FormatInt(since.UnixNano(), 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, Unavailable("load alert events", err, defaultRetryAfter)
+	}
+
+	events := make([]*AlertEvent, 0, len(values))
+	for _, value := range values {
+		event := &AlertEvent{}
+		if err := json.Unmarshal([]byte(value), event); err != nil {
+			return nil, Internal("load alert events", err)
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// MemoryAlertStore keeps alerts in memory, e.g. for tests or single instance deployments without Redis
+type MemoryAlertStore struct {
+	mu     sync.Mutex
+	alerts map[string]Alert
+	events map[string][]AlertEvent
+}
+
+func (store *MemoryAlertStore) SaveAlert(ctx context.Context, alert *Alert) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.alerts == nil {
+		store.alerts = map[string]Alert{}
+	}
+	store.alerts[alert.ID] = *alert
+	return nil
+}
+
+func (store *MemoryAlertStore) UpdateAlert(ctx context.Context, alert *Alert) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if _, ok := store.alerts[alert.ID]; ok {
+		store.alerts[alert.ID] = *alert
+	}
+	return nil
+}
+
+func (store *MemoryAlertStore) DeleteAlert(ctx context.Context, id string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.alerts, id)
+	return nil
+}
+
+func (store *MemoryAlertStore) LoadAlert(ctx context.Context, id string) (*Alert, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	alert, ok := store.alerts[id]
+	if !ok {
+		return nil, nil
+	}
+	return &alert, nil
+}
+
+func (store *MemoryAlertStore) LoadAlerts(ctx context.Context) ([]*Alert, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	alerts := make([]*Alert, 0, len(store.alerts))
+	for _, alert := range store.alerts {
+		alert := alert
+		alerts = append(alerts, &alert)
+	}
+	return alerts, nil
+}
+
+func (store *MemoryAlertStore) SaveEvent(ctx context.Context, event *AlertEvent) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.events == nil {
+		store.events = map[string][]AlertEvent{}
+	}
+	events := append(store.events[event.Alert.Owner], *event)
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	if len(events) > maxStoredAlertEvents {
+		events = events[len(events)-maxStoredAlertEvents:]
+	}
+	store.events[event.Alert.Owner] = events
+	return nil
+}
+
+func (store *MemoryAlertStore) LoadEvents(ctx context.Context, owner string, since time.Time) ([]*AlertEvent, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	var events []*AlertEvent
+	for _, event := range store.events[owner] {
+		if !event.Time.Before(since) {
+			event := event
+			events = append(events, &event)
+		}
+	}
+	return events, nil
+}
@@ -0,0 +1,441 @@
+package Server
+
+import (
+	pricepb "BTCPrice/protofiles"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultMaxAlerts = 100
+	// Longest window a PERCENT_CHANGE alert may watch
+	maxAlertWindow = 24 * time.Hour
+	// Triggered alerts buffered per watcher before they are dropped
+	alertWatcherBuffer = 16
+	// Owner of alerts created without authentication
+	anonymousOwner = "anonymous"
+	// How long the alerts read from the store are evaluated before they are read again,
+	// so the changes made through any replica apply within this delay
+	alertRefresh = time.Second
+	// Type of the alert messages on the broker
+	alertMessageType = "btcprice.alert"
+)
+
+// Alert is a price condition registered by a client
+type Alert struct {
+	ID                 string                 `json:"id"`
+	Owner              string                 `json:"owner"`
+	Asset              string                 `json:"asset"`
+	Currency           string                 `json:"currency"`
+	Condition          pricepb.AlertCondition `json:"condition"`
+	Threshold          float64                `json:"threshold,omitempty"`
+	Percent            float64                `json:"percent,omitempty"`
+	WindowMinutes      int32                  `json:"window_minutes,omitempty"`
+	CreatedAt          time.Time              `json:"created_at"`
+	LastTriggeredAt    time.Time              `json:"last_triggered_at"`
+	LastTriggeredPrice float64                `json:"last_triggered_price,omitempty"`
+	// Armed is cleared when the alert triggers and set again once its condition no longer holds,
+	// so an alert fires once per crossing rather than on every tick
+	Armed bool `json:"armed"`
+}
+
+func (a *Alert) window() time.Duration {
+	return time.Duration(a.WindowMinutes) * time.Minute
+}
+
+// Convert the alert to its protobuf form
+func (a *Alert) Proto() *pricepb.Alert {
+	res := &pricepb.Alert{
+		Id:                 a.ID,
+		Asset:              a.Asset,
+		Currency:           a.Currency,
+		Condition:          a.Condition,
+		Threshold:          a.Threshold,
+		Percent:            a.Percent,
+		WindowMinutes:      a.WindowMinutes,
+		CreatedAt:          a.CreatedAt.Format(time.RFC3339),
+		LastTriggeredPrice: a.LastTriggeredPrice,
+	}
+	if !a.LastTriggeredAt.IsZero() {
+		res.LastTriggeredAt = a.LastTriggeredAt.Format(time.RFC3339)
+	}
+	return res
+}
+
+// AlertEvent records an alert triggering
+type AlertEvent struct {
+	Alert         Alert     `json:"alert"`
+	Time          time.Time `json:"timedate"`
+	Price         float64   `json:"price"`
+	ChangePercent float64   `json:"change_percent,omitempty"`
+}
+
+// Convert the event to its protobuf form
+func (e *AlertEvent) Proto() *pricepb.AlertEvent {
+	return &pricepb.AlertEvent{
+		Alert:         e.Alert.Proto(),
+		Timedate:      e.Time.Format(time.RFC3339),
+		Price:         e.Price,
+		ChangePercent: e.ChangePercent,
+	}
+}
+
+type priceSample struct {
+	time  time.Time
+	price float64
+}
+
+// AlertEngine evaluates the registered alerts against every published price
+// and delivers the triggered ones to the owners watching them
+type AlertEngine struct {
+	// Store is shared by every replica and is the record of the alerts
+	Store AlertStore
+	// MaxAlerts limits the alerts of each client; zero means unlimited
+	MaxAlerts int
+	// Broker carries the triggered alerts to the watchers on every replica; nil only delivers them on this one
+	Broker Broker
+
+	mu sync.Mutex
+	// The alerts as last read from the store, which the prices are evaluated against
+	alerts map[string]*Alert
+	loaded time.Time
+	// Recent prices by asset and currency, kept for PERCENT_CHANGE alerts
+	samples   map[string][]priceSample
+	watchers  map[string]map[chan *AlertEvent]bool
+	listeners []func(context.Context, *AlertEvent)
+}
+
+// Create a new alert engine, loading the stored alerts
+func NewAlertEngine(ctx context.Context, store AlertStore, maxAlerts int) (*AlertEngine, error) {
+	alerts, err := store.LoadAlerts(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load alerts: %v", err)
+	}
+
+	engine := &AlertEngine{
+		Store:     store,
+		MaxAlerts: maxAlerts,
+		samples:   map[string][]priceSample{},
+		watchers:  map[string]map[chan *AlertEvent]bool{},
+	}
+	engine.setAlerts(alerts)
+	return engine, nil
+}
+
+// Create an alert engine storing alerts in Redis, with MAX_ALERTS_PER_CLIENT alerts per client
+func NewAlertEngineFromEnv(ctx context.Context) (*AlertEngine, error) {
+	return NewAlertEngine(ctx, &RedisAlertStore{RedisClient: NewRedisClient()}, envInt("MAX_ALERTS_PER_CLIENT", defaultMaxAlerts))
+}
+
+// The client owning the alerts and webhooks created in the context
+func ownerFromContext(ctx context.Context) string {
+	if principal, ok := PrincipalFromContext(ctx); ok && principal.ID != "" {
+		return principal.ID
+	}
+	return anonymousOwner
+}
+
+// Register an alert
+func (e *AlertEngine) Create(ctx context.Context, alert *Alert) (*Alert, error) {
+	alert.ID = newSubscriptionID()
+	alert.CreatedAt = time.Now().UTC()
+	alert.Armed = true
+
+	if e.MaxAlerts > 0 {
+		owned, err := e.List(ctx, alert.Owner)
+		if err != nil {
+			return nil, err
+		}
+		if len(owned) >= e.MaxAlerts {
+			return nil, status.Errorf(codes.ResourceExhausted, "alert limit of %d reached", e.MaxAlerts)
+		}
+	}
+	if err := e.Store.SaveAlert(ctx, alert); err != nil {
+		return nil, err
+	}
+
+	// The other replicas see the alert on their next refresh
+	e.mu.Lock()
+	e.alerts[alert.ID] = alert
+	e.mu.Unlock()
+	copied := *alert
+	return &copied, nil
+}
+
+// List the stored alerts of the owner, oldest first
+func (e *AlertEngine) List(ctx context.Context, owner string) ([]*Alert, error) {
+	stored, err := e.Store.LoadAlerts(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var alerts []*Alert
+	for _, alert := range stored {
+		if alert.Owner == owner {
+			alerts = append(alerts, alert)
+		}
+	}
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].CreatedAt.Before(alerts[j].CreatedAt) })
+	return alerts, nil
+}
+
+// Delete an alert of the owner
+func (e *AlertEngine) Delete(ctx context.Context, owner string, id string) error {
+	alert, err := e.Store.LoadAlert(ctx, id)
+	if err != nil {
+		return err
+	}
+	if alert == nil || alert.Owner != owner {
+		return NotFound("delete alert", fmt.Errorf("no alert with id %q", id))
+	}
+	if err := e.Store.DeleteAlert(ctx, id); err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	delete(e.alerts, id)
+	e.mu.Unlock()
+	return nil
+}
+
+// Replace the alerts evaluated with those read from the store
+func (e *AlertEngine) setAlerts(alerts []*Alert) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.alerts = make(map[string]*Alert, len(alerts))
+	for _, alert := range alerts {
+		e.alerts[alert.ID] = alert
+	}
+	e.loaded = time.Now()
+}
+
+// Read the alerts from the store again when the copy evaluated is older than alertRefresh,
+// keeping the copy when the store cannot be read
+func (e *AlertEngine) refresh(ctx context.Context) {
+	e.mu.Lock()
+	fresh := time.Since(e.loaded) < alertRefresh
+	e.mu.Unlock()
+	if fresh {
+		return
+	}
+
+	alerts, err := e.Store.LoadAlerts(ctx)
+	if err != nil {
+		loggerFromContext(ctx).Warn("failed to reload alerts", "error", err)
+		return
+	}
+	e.setAlerts(alerts)
+}
+
+// Evaluate the alerts on the asset and currency against a new price
+func (e *AlertEngine) Evaluate(ctx context.Context, asset string, currency string, price float64, at time.Time) {
+	var changed []*Alert
+	var events []*AlertEvent
+
+	e.refresh(ctx)
+	e.mu.Lock()
+	key := asset + "/" + currency
+	var window time.Duration
+	for _, alert := range e.alerts {
+		if alert.Asset == asset && alert.Currency == currency && alert.Condition == pricepb.AlertCondition_PERCENT_CHANGE {
+			window = max(window, alert.window())
+		}
+	}
+	if window > 0 {
+		e.samples[key] = appendSample(e.samples[key], priceSample{time: at, price: price}, at.Add(-window))
+	} else {
+		delete(e.samples, key)
+	}
+
+	for _, alert := range e.alerts {
+		if alert.Asset != asset || alert.Currency != currency {
+			continue
+		}
+
+		holds, changePercent := e.conditionHoldsLocked(alert, key, price, at)
+		switch {
+		case holds && alert.Armed:
+			alert.Armed = false
+			alert.LastTriggeredAt = at
+			alert.LastTriggeredPrice = price
+			events = append(events, &AlertEvent{Alert: *alert, Time: at, Price: price, ChangePercent: changePercent})
+		case !holds && !alert.Armed:
+			alert.Armed = true
+		default:
+			continue
+		}
+		copied := *alert
+		changed = append(changed, &copied)
+	}
+	e.mu.Unlock()
+
+	logger := loggerFromContext(ctx)
+	for _, alert := range changed {
+		// An alert deleted on another replica since it was read is not written back
+		if err := e.Store.UpdateAlert(ctx, alert); err != nil {
+			logger.Warn("failed to save alert", "alert_id", alert.ID, "error", err)
+		}
+	}
+	for _, event := range events {
+		logger.Info("alert triggered", "alert_id", event.Alert.ID, "owner", event.Alert.Owner, "price", event.Price)
+		if err := e.Store.SaveEvent(ctx, event); err != nil {
+			logger.Warn("failed to save alert event", "alert_id", event.Alert.ID, "error", err)
+		}
+		e.deliver(ctx, event)
+	}
+}
+
+// Check the alert's condition, returning the move in percent for PERCENT_CHANGE alerts
+func (e *AlertEngine) conditionHoldsLocked(alert *Alert, key string, price float64, at time.Time) (bool, float64) {
+	switch alert.Condition {
+	case pricepb.AlertCondition_PRICE_ABOVE:
+		return price >= alert.Threshold, 0
+	case pricepb.AlertCondition_PRICE_BELOW:
+		return price <= alert.Threshold, 0
+	case pricepb.AlertCondition_PERCENT_CHANGE:
+		// Compare with the oldest price within the window
+		from := at.Add(-alert.window())
+		for _, sample := range e.samples[key] {
+			if sample.time.Before(from) || sample.price == 0 {
+				continue
+			}
+			change := (price - sample.price) / sample.price * 100
+			return math.Abs(change) >= alert.Percent, change
+		}
+	}
+	return false, 0
+}
+
+// Append the sample, dropping the samples older than the cutoff
+func appendSample(samples []priceSample, sample priceSample, cutoff time.Time) []priceSample {
+	i := 0
+	for i < len(samples) && samples[i].time.Before(cutoff) {
+		i++
+	}
+	return append(samples[i:], sample)
+}
+
+// Send the event to the watchers of its owner on every replica, and to the listeners of this one
+func (e *AlertEngine) deliver(ctx context.Context, event *AlertEvent) {
+	if e.Broker == nil {
+		e.notifyWatchers(ctx, event)
+	} else if err := e.publish(ctx, event); err != nil {
+		loggerFromContext(ctx).Warn("failed to publish alert event", "alert_id", event.Alert.ID, "error", err)
+	}
+
+	e.mu.Lock()
+	listeners := e.listeners
+	e.mu.Unlock()
+	for _, listener := range listeners {
+		listener(ctx, event)
+	}
+}
+
+// Send the event to the watchers of its owner on this replica
+func (e *AlertEngine) notifyWatchers(ctx context.Context, event *AlertEvent) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for watcher := range e.watchers[event.Alert.Owner] {
+		select {
+		case watcher <- event:
+		default:
+			loggerFromContext(ctx).Warn("alert watcher is too slow, dropping event", "alert_id", event.Alert.ID)
+		}
+	}
+}
+
+// Publish the event to the alert topic of the broker
+func (e *AlertEngine) publish(ctx context.Context, event *AlertEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal alert event: %v", err)
+	}
+	msg := &BrokerMessage{
+		ID:          newSubscriptionID(),
+		ContentType: ContentTypeJSON,
+		Type:        alertMessageType,
+		Timestamp:   time.Now().UTC(),
+		Headers:     map[string]string{},
+		Body:        body,
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(msg.Headers))
+	return e.Broker.Publish(ctx, AlertTopic, msg)
+}
+
+// Deliver the alerts triggered on any replica to the watchers on this one until the context is done,
+// subscribing again when the subscription is lost. Without a broker there is nothing to receive.
+func (e *AlertEngine) Run(ctx context.Context) {
+	if e.Broker == nil {
+		return
+	}
+	logger := loggerFromContext(ctx)
+
+	for attempt := 0; ; attempt++ {
+		msgs, err := e.Broker.Subscribe(ctx, AlertTopic)
+		if err != nil {
+			logger.Warn("failed to subscribe to alert events", "attempt", attempt, "error", err)
+		} else {
+			attempt = 0
+			for msg := range msgs {
+				event := &AlertEvent{}
+				if err := json.Unmarshal(msg.Body, event); err != nil {
+					logger.Warn("error unmarshalling alert event", "message_id", msg.ID, "error", err)
+					continue
+				}
+				e.notifyWatchers(ctx, event)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(jitteredBackoff(time.Second, 30*time.Second, attempt+1)):
+		}
+	}
+}
+
+// Register a function called with every triggered alert
+func (e *AlertEngine) OnTrigger(listener func(context.Context, *AlertEvent)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.listeners = append(e.listeners, listener)
+}
+
+// Watch the alerts of the owner as they trigger. The returned function stops watching.
+func (e *AlertEngine) Watch(owner string) (<-chan *AlertEvent, func()) {
+	watcher := make(chan *AlertEvent, alertWatcherBuffer)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.watchers[owner] == nil {
+		e.watchers[owner] = map[chan *AlertEvent]bool{}
+	}
+	e.watchers[owner][watcher] = true
+
+	var once sync.Once
+	return watcher, func() {
+		once.Do(func() {
+			e.mu.Lock()
+			defer e.mu.Unlock()
+			delete(e.watchers[owner], watcher)
+			if len(e.watchers[owner]) == 0 {
+				delete(e.watchers, owner)
+			}
+		})
+	}
+}
+
+// The stored events of the owner since the time, oldest first
+func (e *AlertEngine) History(ctx context.Context, owner string, since time.Time) ([]*AlertEvent, error) {
+	return e.Store.LoadEvents(ctx, owner, since)
+}
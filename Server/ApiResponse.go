@@ -1,10 +1,26 @@
 package Server
 
+import "time"
+
+// Rate is the price of an asset in one currency
+type Rate struct {
+	RateFloat float64 `json:"rate_float"`
+}
+
 type APIResponse struct {
 	Time struct {
 		UpdatedISO string `json:"updatedISO"`
 	} `json:"time"`
-	Bpi map[string]struct {
-		RateFloat float64 `json:"rate_float"`
-	} `json:"bpi"`
+	Bpi map[string]Rate `json:"bpi"`
+	// FetchedAt is when the response was received
+	FetchedAt time.Time `json:"-"`
+}
+
+// When the source last updated its prices, or the zero time if it did not say
+func (r *APIResponse) UpdatedAt() time.Time {
+	updated, err := time.Parse(time.RFC3339, r.Time.UpdatedISO)
+	if err != nil {
+		return time.Time{}
+	}
+	return updated
 }
@@ -0,0 +1,124 @@
+package Server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultAsset is priced when a request does not name an asset
+const DefaultAsset = "BTC"
+
+const coinGeckoURL = "https://api.coingecko.com/api/v3"
+
+// CoinGecko IDs of the crypto assets that can be priced
+var cryptoAssets = map[string]string{
+	"BTC": "bitcoin",
+	"ETH": "ethereum",
+	"LTC": "litecoin",
+	"SOL": "solana",
+}
+
+var (
+	assetSourcesMu sync.Mutex
+	assetSources   = map[string]*PriceSource{}
+)
+
+// The price source shared by every publisher of the asset.
+// Bitcoin keeps the CoinDesk source, other assets are priced by CoinGecko.
+func PriceSourceFor(asset string) (*PriceSource, bool) {
+	if asset == DefaultAsset {
+		return DefaultPriceSource(), true
+	}
+	id, ok := cryptoAssets[asset]
+	if !ok {
+		return nil, false
+	}
+
+	assetSourcesMu.Lock()
+	defer assetSourcesMu.Unlock()
+	source, ok := assetSources[asset]
+	if !ok {
+		source = NewCoinGeckoSource(asset, id)
+		assetSources[asset] = source
+	}
+	return source, true
+}
+
+// Create a CoinGecko source for the asset
+func NewCoinGeckoSource(asset string, id string) *PriceSource {
+	baseURL := os.Getenv("COINGECKO_URL")
+	if baseURL == "" {
+		baseURL = coinGeckoURL // default value
+	}
+
+	currencies := []string{"USD", "EUR", "GBP"}
+	name := "coingecko-" + strings.ToLower(asset)
+	return &PriceSource{
+		Name:         name,
+		URL:          fmt.Sprintf("%s/simple/price?ids=%s&vs_currencies=%s&include_last_updated_at=true", baseURL, url.QueryEscape(id), strings.ToLower(strings.Join(currencies, ","))),
+		Currencies:   currencies,
+		BaseCurrency: "USD",
+		Decode:       coinGeckoDecoder(id),
+		Client:       &http.Client{Timeout: envDuration("PRICE_SOURCE_TIMEOUT", 5*time.Second)},
+		Breaker:      NewCircuitBreaker(name, envInt("BREAKER_FAILURE_THRESHOLD", 5), envDuration("BREAKER_OPEN_TIMEOUT", 30*time.Second)),
+		MaxRetries:   envInt("PRICE_SOURCE_RETRIES", 2),
+		BaseDelay:    200 * time.Millisecond,
+		MaxDelay:     2 * time.Second,
+	}
+}
+
+// Decode a CoinGecko simple price response, e.g. {"ethereum": {"usd": 2300.5, "last_updated_at": 1704067200}}
+func coinGeckoDecoder(id string) func(io.Reader) (*APIResponse, error) {
+	return func(body io.Reader) (*APIResponse, error) {
+		var prices map[string]map[string]float64
+		if err := json.NewDecoder(body).Decode(&prices); err != nil {
+			return nil, err
+		}
+		quotes, ok := prices[id]
+		if !ok {
+			return nil, fmt.Errorf("no prices for %s", id)
+		}
+
+		data := &APIResponse{Bpi: map[string]Rate{}}
+		for currency, price := range quotes {
+			if currency == "last_updated_at" {
+				data.Time.UpdatedISO = time.Unix(int64(price), 0).UTC().Format(time.RFC3339)
+				continue
+			}
+			data.Bpi[strings.ToUpper(currency)] = Rate{RateFloat: price}
+		}
+		return data, nil
+	}
+}
+
+// Read the assets clients may subscribe to from SUPPORTED_ASSETS (default BTC and ETH)
+func SupportedAssetsFromEnv() ([]string, error) {
+	value := os.Getenv("SUPPORTED_ASSETS")
+	if value == "" {
+		return []string{"BTC", "ETH"}, nil // default value
+	}
+
+	var assets []string
+	for _, asset := range strings.Split(value, ",") {
+		asset = strings.ToUpper(strings.TrimSpace(asset))
+		if _, ok := cryptoAssets[asset]; !ok {
+			return nil, fmt.Errorf("unknown asset in SUPPORTED_ASSETS: %q", asset)
+		}
+		assets = append(assets, asset)
+	}
+	sort.Strings(assets)
+	return assets, nil
+}
+
+// Queue name of the asset and currency. Bitcoin queues keep their original "btcprice" names.
+func queueName(asset string, currency string) string {
+	return strings.ToLower(asset) + "price" + currency
+}
@@ -0,0 +1,166 @@
+package Server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	apiKeyHeader        = "x-api-key"
+	authorizationHeader = "authorization"
+)
+
+// ErrNoCredentials is returned by an Authenticator when the request carries none of the credentials it handles
+var ErrNoCredentials = errors.New("no credentials")
+
+// Principal is the authenticated identity of a caller
+type Principal struct {
+	ID     string
+	Method string
+}
+
+// Authenticator verifies the credentials carried in the incoming metadata
+type Authenticator interface {
+	Authenticate(ctx context.Context, md metadata.MD) (*Principal, error)
+}
+
+type principalKey struct{}
+
+// Attach the principal to the context
+func ContextWithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// Retrieve the principal attached to the context
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(*Principal)
+	return principal, ok
+}
+
+// chainAuthenticator tries each authenticator in turn until one recognizes the credentials
+type chainAuthenticator []Authenticator
+
+// Combine several authenticators into one
+func ChainAuthenticators(authenticators ...Authenticator) Authenticator {
+	return chainAuthenticator(authenticators)
+}
+
+func (chain chainAuthenticator) Authenticate(ctx context.Context, md metadata.MD) (*Principal, error) {
+	for _, auth := range chain {
+		principal, err := auth.Authenticate(ctx, md)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		return principal, err
+	}
+	return nil, ErrNoCredentials
+}
+
+// Create the authenticator configured in the environment.
+// Verified client certificates are accepted when TLS_CLIENT_CA_FILE is set.
+// API keys are read from API_KEYS_FILE or, when API_KEYS_REDIS is "true", from Redis;
+// JWTs are verified against the JWKS in JWT_JWKS_FILE. A nil authenticator is returned
+// only when AUTH_DISABLED is "true".
+func NewAuthenticatorFromEnv() (Authenticator, error) {
+	if os.Getenv("AUTH_DISABLED") == "true" {
+		return nil, nil
+	}
+
+	var authenticators []Authenticator
+	if os.Getenv("TLS_CLIENT_CA_FILE") != "" {
+		authenticators = append(authenticators, NewClientCertAuthenticator())
+	}
+	if path := os.Getenv("API_KEYS_FILE"); path != "" {
+		store, err := NewFileKeyStore(path)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, NewAPIKeyAuthenticator(store))
+	}
+	if os.Getenv("API_KEYS_REDIS") == "true" {
+		authenticators = append(authenticators, NewAPIKeyAuthenticator(NewRedisKeyStore(NewRedisClient())))
+	}
+	if path := os.Getenv("JWT_JWKS_FILE"); path != "" {
+		auth, err := NewJWTAuthenticator(path, os.Getenv("JWT_ISSUER"), os.Getenv("JWT_AUDIENCE"))
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, auth)
+	}
+
+	if len(authenticators) == 0 {
+		return nil, fmt.Errorf("no authentication configured: set TLS_CLIENT_CA_FILE, API_KEYS_FILE, API_KEYS_REDIS or JWT_JWKS_FILE, or AUTH_DISABLED=true")
+	}
+	return ChainAuthenticators(authenticators...), nil
+}
+
+// Authenticate the call and return the context carrying the principal
+func authenticate(ctx context.Context, auth Authenticator) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	principal, err := auth.Authenticate(ctx, md)
+	if errors.Is(err, ErrNoCredentials) {
+		return nil, status.Error(codes.Unauthenticated, "missing credentials")
+	}
+	// The credentials may well be valid when the store holding them is down
+	var serviceErr *Error
+	if errors.As(err, &serviceErr) && serviceErr.Kind == KindUnavailable {
+		slog.Error("failed to check credentials", "error", err)
+		return nil, ToStatus(err)
+	}
+	if err != nil {
+		slog.Warn("authentication failed", "error", err)
+		return nil, status.Error(codes.Unauthenticated, "invalid credentials")
+	}
+	return ContextWithPrincipal(ctx, principal), nil
+}
+
+// authenticatedStream overrides the stream context with one carrying the principal
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// Create a stream interceptor that rejects unauthenticated calls
+func StreamAuthInterceptor(auth Authenticator) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := authenticate(ss.Context(), auth)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &authenticatedStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// Create a unary interceptor that rejects unauthenticated calls
+func UnaryAuthInterceptor(auth Authenticator) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := authenticate(ctx, auth)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// Extract the bearer token from the authorization header
+func bearerToken(md metadata.MD) (string, bool) {
+	for _, value := range md.Get(authorizationHeader) {
+		if token, ok := strings.CutPrefix(value, "Bearer "); ok && token != "" {
+			return token, true
+		}
+	}
+	return "", false
+}
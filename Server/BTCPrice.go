@@ -1,8 +1,84 @@
 package Server
 
-import "time"
+import (
+	pricepb "BTCPrice/protofiles"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
 
-type BTCPrice struct {
+// Price is a quote for one crypto asset, as published to RabbitMQ
+type Price struct {
+	// Asset is empty in messages published before other assets were supported, meaning BTC
+	Asset string `json:"asset,omitempty"`
+	// Currency is empty in older messages, where the queue tells it
+	Currency string `json:"currency,omitempty"`
+	// Time is when the tick was taken, zero in older messages
 	Time  time.Time `json:"timedate"`
 	Price float64   `json:"price"`
+	// Source is the price source the quote came from
+	Source string `json:"source,omitempty"`
+	// SourceTime is when the source last updated the price, zero if it did not say
+	SourceTime time.Time `json:"source_time"`
+	// FetchTime is when the price was fetched from the source
+	FetchTime time.Time `json:"fetch_time"`
+	// Sequence numbers the ticks of the asset and currency across the replicas, 0 when unassigned
+	Sequence uint64 `json:"sequence,omitempty"`
+	// TickID identifies the tick on every replica, e.g. "BTC-USD-42"
+	TickID string `json:"tick_id,omitempty"`
+}
+
+// BTCPrice is the original name of Price, from when only Bitcoin was quoted
+type BTCPrice = Price
+
+// Convert the price to the response sent to subscribers, filling in what older messages lack
+func (price *Price) Response(currency string, received time.Time) *pricepb.SubscribeResponse {
+	res := &pricepb.SubscribeResponse{
+		Asset:      price.Asset,
+		Currency:   price.Currency,
+		Timedate:   price.Time.Format(time.RFC3339),
+		Price:      price.Price,
+		Source:     price.Source,
+		SourceTime: formatOptionalTime(price.SourceTime),
+		FetchTime:  formatOptionalTime(price.FetchTime),
+		Sequence:   price.Sequence,
+		TickId:     price.TickID,
+	}
+	if res.Asset == "" {
+		res.Asset = DefaultAsset
+	}
+	if res.Currency == "" {
+		res.Currency = currency
+	}
+	if price.Time.IsZero() {
+		res.Timedate = received.Format(time.RFC3339)
+	}
+	return res
+}
+
+// ID of the tick of the asset and currency with the sequence number
+func TickID(asset string, currency string, sequence uint64) string {
+	return fmt.Sprintf("%s-%s-%d", asset, currency, sequence)
+}
+
+// Split a tick ID into its asset, currency and sequence number
+func ParseTickID(id string) (asset string, currency string, sequence uint64, err error) {
+	parts := strings.Split(id, "-")
+	if len(parts) != 3 {
+		return "", "", 0, fmt.Errorf("invalid tick ID %q", id)
+	}
+	sequence, err = strconv.ParseUint(parts[2], 10, 64)
+	if err != nil || sequence == 0 {
+		return "", "", 0, fmt.Errorf("invalid tick ID %q", id)
+	}
+	return parts[0], parts[1], sequence, nil
+}
+
+// Format a time with sub-second precision, or as empty when it is unknown
+func formatOptionalTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
 }
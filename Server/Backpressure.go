@@ -0,0 +1,257 @@
+package Server
+
+import (
+	pricepb "BTCPrice/protofiles"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultSubscriberBuffer  = 64
+	defaultHeartbeatInterval = 15 * time.Second
+)
+
+// OverflowPolicy decides what happens to a subscriber whose buffer is full
+type OverflowPolicy string
+
+const (
+	// Drop the oldest buffered price to make room for the new one
+	DropOldest OverflowPolicy = "drop_oldest"
+	// Keep only the latest price of each currency while the subscriber is behind
+	ConflateLatest OverflowPolicy = "conflate"
+	// End the subscription with ResourceExhausted
+	Disconnect OverflowPolicy = "disconnect"
+)
+
+// BackpressureConfig bounds the prices buffered for each subscriber
+type BackpressureConfig struct {
+	// BufferSize is the number of prices buffered per subscriber; zero uses the default of 64
+	BufferSize int
+	// Policy applies when the buffer is full; empty means DropOldest
+	Policy OverflowPolicy
+	// HeartbeatInterval is how long a subscriber waits without a price before it is sent a heartbeat;
+	// zero uses the default of 15s
+	HeartbeatInterval time.Duration
+}
+
+// Read the backpressure configuration from SUBSCRIBER_BUFFER, SUBSCRIBER_OVERFLOW_POLICY and HEARTBEAT_INTERVAL
+func BackpressureConfigFromEnv() (BackpressureConfig, error) {
+	config := BackpressureConfig{
+		BufferSize:        envInt("SUBSCRIBER_BUFFER", defaultSubscriberBuffer),
+		Policy:            DropOldest, // default value
+		HeartbeatInterval: envDuration("HEARTBEAT_INTERVAL", defaultHeartbeatInterval),
+	}
+	if value := os.Getenv("SUBSCRIBER_OVERFLOW_POLICY"); value != "" {
+		switch policy := OverflowPolicy(strings.ToLower(value)); policy {
+		case DropOldest, ConflateLatest, Disconnect:
+			config.Policy = policy
+		default:
+			return config, fmt.Errorf("invalid SUBSCRIBER_OVERFLOW_POLICY %q, expected drop_oldest, conflate or disconnect", value)
+		}
+	}
+	return config, nil
+}
+
+type bufferedResponse struct {
+	// The trace context of the delivery the response came from
+	ctx context.Context
+	res *pricepb.SubscribeResponse
+	// Reliable responses, such as history, are never dropped or conflated
+	reliable bool
+}
+
+// SubscriberBuffer decouples the broker from a subscriber's stream,
+// so a slow client never stalls the consumption of its queues.
+// Its Run loop is the only goroutine sending on the stream, in the order the prices were pushed.
+type SubscriberBuffer struct {
+	size      int
+	policy    OverflowPolicy
+	heartbeat time.Duration
+
+	mu      sync.Mutex
+	pending []bufferedResponse
+	// Number of live prices pending, which the size bounds
+	live int
+	// Number of reliable responses pending, which the size bounds as well
+	reliable int
+	// Whether anything was pushed since the last heartbeat was due
+	active bool
+	ready  chan struct{}
+	// Signalled when a reliable response is taken, to wake a blocked PushReliable
+	space chan struct{}
+}
+
+// Create a subscriber buffer
+func NewSubscriberBuffer(config BackpressureConfig) *SubscriberBuffer {
+	if config.BufferSize <= 0 {
+		config.BufferSize = defaultSubscriberBuffer
+	}
+	if config.Policy == "" {
+		config.Policy = DropOldest
+	}
+	if config.HeartbeatInterval <= 0 {
+		config.HeartbeatInterval = defaultHeartbeatInterval
+	}
+	return &SubscriberBuffer{
+		size:      config.BufferSize,
+		policy:    config.Policy,
+		heartbeat: config.HeartbeatInterval,
+		ready:     make(chan struct{}, 1),
+		space:     make(chan struct{}, 1),
+	}
+}
+
+// Buffer a price for the subscriber without blocking.
+// An error means the subscriber is too slow and should be disconnected.
+func (b *SubscriberBuffer) Push(ctx context.Context, res *pricepb.SubscribeResponse) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.policy == ConflateLatest {
+		// Replace the price still waiting for the same currency,
+		// which counts as a drop only when the subscriber has fallen behind
+		for i, pending := range b.pending {
+			if !pending.reliable && pending.res.GetAsset() == res.GetAsset() && pending.res.GetCurrency() == res.GetCurrency() {
+				b.pending[i] = bufferedResponse{ctx: ctx, res: res}
+				if b.live >= b.size {
+					subscriberDrops.WithLabelValues(string(b.policy)).Inc()
+				}
+				return nil
+			}
+		}
+	}
+
+	if b.live >= b.size {
+		subscriberDrops.WithLabelValues(string(b.policy)).Inc()
+		if b.policy == Disconnect {
+			return status.Errorf(codes.ResourceExhausted, "subscriber fell %d prices behind", b.size)
+		}
+		b.dropOldestLocked()
+	}
+	b.appendLocked(bufferedResponse{ctx: ctx, res: res})
+	return nil
+}
+
+// Buffer a price that must not be dropped, such as history, behind the prices already buffered.
+// It blocks while the buffer holds as many reliable prices as its size, until the context is done.
+func (b *SubscriberBuffer) PushReliable(ctx context.Context, res *pricepb.SubscribeResponse) error {
+	for {
+		b.mu.Lock()
+		if b.reliable < b.size {
+			b.appendLocked(bufferedResponse{ctx: ctx, res: res, reliable: true})
+			b.mu.Unlock()
+			return nil
+		}
+		b.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-b.space:
+		}
+	}
+}
+
+// Push heartbeats until the context is done, whenever the heartbeat interval passes without anything pushed,
+// so the client and the proxies in between can tell an idle stream from a dead one
+func (b *SubscriberBuffer) Heartbeat(ctx context.Context) {
+	tick := time.NewTicker(b.heartbeat)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+
+		b.mu.Lock()
+		if !b.active && len(b.pending) == 0 {
+			b.appendLocked(bufferedResponse{ctx: ctx, res: &pricepb.SubscribeResponse{Heartbeat: true}, reliable: true})
+		}
+		b.active = false
+		b.mu.Unlock()
+	}
+}
+
+func (b *SubscriberBuffer) appendLocked(next bufferedResponse) {
+	b.pending = append(b.pending, next)
+	if next.reliable {
+		b.reliable++
+	} else {
+		b.live++
+	}
+	b.active = true
+
+	select {
+	case b.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Drop the oldest live price
+func (b *SubscriberBuffer) dropOldestLocked() {
+	for i, pending := range b.pending {
+		if !pending.reliable {
+			b.pending = append(b.pending[:i], b.pending[i+1:]...)
+			b.live--
+			return
+		}
+	}
+}
+
+// Take the oldest buffered price
+func (b *SubscriberBuffer) pop() (bufferedResponse, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.pending) == 0 {
+		return bufferedResponse{}, false
+	}
+	next := b.pending[0]
+	b.pending = b.pending[1:]
+	if next.reliable {
+		b.reliable--
+		select {
+		case b.space <- struct{}{}:
+		default:
+		}
+	} else {
+		b.live--
+	}
+	return next, true
+}
+
+// Send the buffered prices to the stream until the context is done or a send fails
+func (b *SubscriberBuffer) Run(ctx context.Context, stream pricepb.PriceService_SubscribeServer) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-b.ready:
+		}
+
+		for {
+			next, ok := b.pop()
+			if !ok {
+				break
+			}
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err := tracedSend(next.ctx, stream, next.res); err != nil {
+				return err
+			}
+			if !next.res.GetHeartbeat() {
+				loggerFromContext(ctx).Debug("sent price update", "currency", next.res.GetCurrency(), "price", next.res.GetPrice())
+			}
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package Server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Topic of the triggered alerts, which every replica receives to serve WatchAlerts
+const AlertTopic = "alerts"
+
+// Broker carries the published prices and alerts to the subscribers of every replica.
+// Each subscriber receives every message of its topic published while it is subscribed.
+type Broker interface {
+	// Publish a message to the subscribers of the topic
+	Publish(ctx context.Context, topic string, msg *BrokerMessage) error
+	// Receive the messages of the topic. The channel is closed when the context
+	// is done, or when the subscription is lost and the caller should subscribe again.
+	Subscribe(ctx context.Context, topic string) (<-chan *BrokerMessage, error)
+	// Close the broker
+	Close() error
+}
+
+// Topic of the prices of the asset and currency, e.g. "btcpriceUSD"
+func PriceTopic(asset string, currency string) string {
+	return queueName(asset, currency)
+}
+
+// BrokerMessage is an encoded price or alert message with its metadata
+type BrokerMessage struct {
+	ID            string
+	ContentType   string
+	SchemaVersion int
+	// Type is the kind of message, e.g. "btcprice.price"
+	Type      string
+	Timestamp time.Time
+	// Headers carry the trace context from the publisher to the consumer
+	Headers map[string]string
+	Body    []byte
+}
+
+// Create the broker named by BROKER: rabbitmq (default), memory or redis
+func NewBrokerFromEnv() (Broker, error) {
+	switch value := strings.ToLower(os.Getenv("BROKER")); value {
+	case "", "rabbitmq":
+		return NewRabbitMQBrokerFromEnv(), nil // default value
+	case "memory":
+		return NewMemoryBroker(), nil
+	case "redis":
+		return NewRedisStreamBroker(NewRedisClient()), nil
+	default:
+		return nil, fmt.Errorf("invalid BROKER %q, expected rabbitmq, memory or redis", value)
+	}
+}
+
+var defaultBroker = sync.OnceValues(NewBrokerFromEnv)
+
+// The broker shared by every publisher, so they share one connection
+func DefaultBroker() (Broker, error) {
+	return defaultBroker()
+}
@@ -0,0 +1,155 @@
+package Server
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrBreakerOpen is returned while the circuit breaker rejects calls
+var ErrBreakerOpen = errors.New("circuit breaker is open")
+
+// BreakerState is the state of a circuit breaker
+type BreakerState int
+
+const (
+	// BreakerClosed lets every call through
+	BreakerClosed BreakerState = iota
+	// BreakerOpen rejects every call until the open timeout expires
+	BreakerOpen
+	// BreakerHalfOpen lets a single trial call through
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// CircuitBreaker stops calling a failing dependency for a while after repeated failures
+type CircuitBreaker struct {
+	Name             string
+	FailureThreshold int
+	OpenTimeout      time.Duration
+
+	mu        sync.Mutex
+	state     BreakerState
+	failures  int
+	openedAt  time.Time
+	trial     bool
+	listeners []func(BreakerState)
+	// State changes made under mu that the listeners are yet to hear about
+	changes []BreakerState
+	// Held while the listeners are called, so they hear about the changes in order
+	notifyMu sync.Mutex
+}
+
+// Create a new circuit breaker that opens after failureThreshold consecutive failures
+func NewCircuitBreaker(name string, failureThreshold int, openTimeout time.Duration) *CircuitBreaker {
+	breakerState.WithLabelValues(name).Set(float64(BreakerClosed))
+	return &CircuitBreaker{Name: name, FailureThreshold: failureThreshold, OpenTimeout: openTimeout}
+}
+
+// Register a function called on every state change
+func (cb *CircuitBreaker) OnStateChange(listener func(BreakerState)) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.listeners = append(cb.listeners, listener)
+}
+
+// The current state of the breaker
+func (cb *CircuitBreaker) State() BreakerState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state
+}
+
+// Check whether a call may go through. While the breaker is open it returns
+// ErrBreakerOpen and how long until a trial call will be allowed.
+func (cb *CircuitBreaker) Allow() (time.Duration, error) {
+	cb.mu.Lock()
+	defer cb.unlockAndNotify()
+
+	switch cb.state {
+	case BreakerOpen:
+		remaining := cb.OpenTimeout - time.Since(cb.openedAt)
+		if remaining > 0 {
+			return remaining, ErrBreakerOpen
+		}
+		cb.setStateLocked(BreakerHalfOpen)
+		cb.trial = true
+		return 0, nil
+	case BreakerHalfOpen:
+		// Only one trial call at a time
+		if cb.trial {
+			return cb.OpenTimeout, ErrBreakerOpen
+		}
+		cb.trial = true
+	}
+	return 0, nil
+}
+
+// Record a successful call
+func (cb *CircuitBreaker) Success() {
+	cb.mu.Lock()
+	defer cb.unlockAndNotify()
+
+	cb.failures = 0
+	cb.trial = false
+	if cb.state != BreakerClosed {
+		cb.setStateLocked(BreakerClosed)
+	}
+}
+
+// Record a failed call
+func (cb *CircuitBreaker) Failure() {
+	cb.mu.Lock()
+	defer cb.unlockAndNotify()
+
+	cb.failures++
+	cb.trial = false
+	if cb.state == BreakerHalfOpen || (cb.state == BreakerClosed && cb.failures >= cb.FailureThreshold) {
+		cb.openedAt = time.Now()
+		cb.setStateLocked(BreakerOpen)
+	}
+}
+
+// Record a call that was given up before it completed
+func (cb *CircuitBreaker) Abandon() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.trial = false
+}
+
+func (cb *CircuitBreaker) setStateLocked(state BreakerState) {
+	cb.state = state
+	breakerState.WithLabelValues(cb.Name).Set(float64(state))
+	cb.changes = append(cb.changes, state)
+}
+
+// Release mu, then call the listeners with the state changes made while it was held,
+// so a listener may call back into the breaker and a slow one does not hold up the calls
+func (cb *CircuitBreaker) unlockAndNotify() {
+	changes, listeners := cb.changes, cb.listeners
+	cb.changes = nil
+	if len(changes) == 0 {
+		cb.mu.Unlock()
+		return
+	}
+
+	cb.notifyMu.Lock()
+	defer cb.notifyMu.Unlock()
+	cb.mu.Unlock()
+	for _, state := range changes {
+		for _, listener := range listeners {
+			listener(state)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package Server
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// Read a float from the environment
+func envFloat(name string, fallback float64) float64 {
+	value, err := strconv.ParseFloat(os.Getenv(name), 64)
+	if err != nil || value < 0 {
+		return fallback // default value
+	}
+	return value
+}
+
+// Read an integer from the environment
+func envInt(name string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || value < 0 {
+		return fallback // default value
+	}
+	return value
+}
+
+// Read a duration such as "30s" from the environment
+func envDuration(name string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(name))
+	if err != nil || value < 0 {
+		return fallback // default value
+	}
+	return value
+}
@@ -0,0 +1,76 @@
+package Server
+
+import (
+	"math"
+	"sort"
+)
+
+// CurrencyInfo describes an ISO 4217 fiat currency
+type CurrencyInfo struct {
+	Code string
+	Name string
+	// Precision is the number of minor unit digits prices are quoted with
+	Precision int
+}
+
+// Fiat currencies that can be quoted directly or converted through FX rates. They are those the
+// Frankfurter FX provider publishes reference rates for; without a rate any other currency cannot be priced.
+var fiatCurrencies = map[string]CurrencyInfo{
+	"AUD": {"AUD", "Australian Dollar", 2},
+	"BGN": {"BGN", "Bulgarian Lev", 2},
+	"BRL": {"BRL", "Brazilian Real", 2},
+	"CAD": {"CAD", "Canadian Dollar", 2},
+	"CHF": {"CHF", "Swiss Franc", 2},
+	"CNY": {"CNY", "Chinese Yuan", 2},
+	"CZK": {"CZK", "Czech Koruna", 2},
+	"DKK": {"DKK", "Danish Krone", 2},
+	"EUR": {"EUR", "Euro", 2},
+	"GBP": {"GBP", "Pound Sterling", 2},
+	"HKD": {"HKD", "Hong Kong Dollar", 2},
+	"HUF": {"HUF", "Hungarian Forint", 2},
+	"IDR": {"IDR", "Indonesian Rupiah", 2},
+	"ILS": {"ILS", "Israeli New Shekel", 2},
+	"INR": {"INR", "Indian Rupee", 2},
+	"ISK": {"ISK", "Icelandic Krona", 0},
+	"JPY": {"JPY", "Japanese Yen", 0},
+	"KRW": {"KRW", "South Korean Won", 0},
+	"MXN": {"MXN", "Mexican Peso", 2},
+	"MYR": {"MYR", "Malaysian Ringgit", 2},
+	"NOK": {"NOK", "Norwegian Krone", 2},
+	"NZD": {"NZD", "New Zealand Dollar", 2},
+	"PHP": {"PHP", "Philippine Peso", 2},
+	"PLN": {"PLN", "Polish Zloty", 2},
+	"RON": {"RON", "Romanian Leu", 2},
+	"SEK": {"SEK", "Swedish Krona", 2},
+	"SGD": {"SGD", "Singapore Dollar", 2},
+	"THB": {"THB", "Thai Baht", 2},
+	"TRY": {"TRY", "Turkish Lira", 2},
+	"USD": {"USD", "US Dollar", 2},
+	"ZAR": {"ZAR", "South African Rand", 2},
+}
+
+// Look up a fiat currency by its ISO 4217 code
+func LookupCurrency(code string) (CurrencyInfo, bool) {
+	info, ok := fiatCurrencies[code]
+	return info, ok
+}
+
+// List the codes of every known fiat currency in order
+func FiatCurrencyCodes() []string {
+	codes := make([]string, 0, len(fiatCurrencies))
+	for code := range fiatCurrencies {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// Round the price to the precision of the currency
+func roundToPrecision(price float64, currency string) float64 {
+	info, ok := fiatCurrencies[currency]
+	if !ok {
+		return price
+	}
+	scale := math.Pow10(info.Precision)
+	return math.Round(price*scale) / scale
+}
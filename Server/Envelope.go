@@ -0,0 +1,155 @@
+package Server
+
+import (
+	pricepb "BTCPrice/protofiles"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// PriceSchemaVersion is the version of the price messages published.
+	// Bare JSON prices without a version are version 1.
+	PriceSchemaVersion = 2
+
+	ContentTypeJSON     = "application/json"
+	ContentTypeProtobuf = "application/x-protobuf"
+
+	// AMQP header carrying the schema version, for consumers routing on it
+	schemaVersionHeader = "x-schema-version"
+	// AMQP type property of the price messages
+	priceMessageType = "btcprice.price"
+)
+
+// PriceEnvelope is a price message on the AMQP queues. Its JSON form extends the
+// bare Price of version 1 with the schema version and message metadata, so
+// consumers of version 1 can still read it.
+type PriceEnvelope struct {
+	SchemaVersion int       `json:"schema_version"`
+	MessageID     string    `json:"message_id"`
+	PublishedAt   time.Time `json:"published_at"`
+	// FencingToken is the term of the leader that published the message, 0 when unknown
+	FencingToken int64 `json:"fencing_token,omitempty"`
+	Price
+}
+
+// Wrap a price for publishing
+func NewPriceEnvelope(price *Price) *PriceEnvelope {
+	return &PriceEnvelope{
+		SchemaVersion: PriceSchemaVersion,
+		MessageID:     newSubscriptionID(),
+		PublishedAt:   time.Now(),
+		Price:         *price,
+	}
+}
+
+// Read the content type of published prices from AMQP_ENCODING, json (default) or protobuf
+func PriceContentTypeFromEnv() (string, error) {
+	switch value := strings.ToLower(os.Getenv("AMQP_ENCODING")); value {
+	case "", "json":
+		return ContentTypeJSON, nil // default value
+	case "protobuf":
+		return ContentTypeProtobuf, nil
+	default:
+		return "", fmt.Errorf("invalid AMQP_ENCODING %q, expected json or protobuf", value)
+	}
+}
+
+// Encode the envelope in the content type
+func (e *PriceEnvelope) Marshal(contentType string) ([]byte, error) {
+	switch contentType {
+	case ContentTypeJSON:
+		return json.Marshal(e)
+	case ContentTypeProtobuf:
+		return proto.Marshal(e.Proto())
+	default:
+		return nil, fmt.Errorf("unsupported content type %q", contentType)
+	}
+}
+
+// Convert the envelope to its protobuf form
+func (e *PriceEnvelope) Proto() *pricepb.PriceMessage {
+	return &pricepb.PriceMessage{
+		SchemaVersion: int32(e.SchemaVersion),
+		MessageId:     e.MessageID,
+		Asset:         e.Asset,
+		Currency:      e.Currency,
+		Price:         e.Price.Price,
+		Timedate:      formatOptionalTime(e.Time),
+		Source:        e.Source,
+		SourceTime:    formatOptionalTime(e.SourceTime),
+		FetchTime:     formatOptionalTime(e.FetchTime),
+		PublishedAt:   formatOptionalTime(e.PublishedAt),
+		FencingToken:  e.FencingToken,
+		Sequence:      e.Sequence,
+		TickId:        e.TickID,
+	}
+}
+
+// Decode a price message of any schema version. An empty content type is read as JSON.
+func DecodePriceEnvelope(contentType string, body []byte) (*PriceEnvelope, error) {
+	envelope := &PriceEnvelope{}
+	switch contentType {
+	case "", ContentTypeJSON:
+		if err := json.Unmarshal(body, envelope); err != nil {
+			return nil, fmt.Errorf("failed to decode price message: %v", err)
+		}
+	case ContentTypeProtobuf:
+		msg := &pricepb.PriceMessage{}
+		if err := proto.Unmarshal(body, msg); err != nil {
+			return nil, fmt.Errorf("failed to decode price message: %v", err)
+		}
+		var err error
+		if envelope, err = envelopeFromProto(msg); err != nil {
+			return nil, fmt.Errorf("failed to decode price message: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported content type %q", contentType)
+	}
+
+	if envelope.SchemaVersion == 0 {
+		envelope.SchemaVersion = 1
+	}
+	return envelope, nil
+}
+
+func envelopeFromProto(msg *pricepb.PriceMessage) (*PriceEnvelope, error) {
+	envelope := &PriceEnvelope{
+		SchemaVersion: int(msg.GetSchemaVersion()),
+		MessageID:     msg.GetMessageId(),
+		FencingToken:  msg.GetFencingToken(),
+		Price: Price{
+			Asset:    msg.GetAsset(),
+			Currency: msg.GetCurrency(),
+			Price:    msg.GetPrice(),
+			Source:   msg.GetSource(),
+			Sequence: msg.GetSequence(),
+			TickID:   msg.GetTickId(),
+		},
+	}
+
+	times := []struct {
+		value  string
+		target *time.Time
+	}{
+		{msg.GetTimedate(), &envelope.Time},
+		{msg.GetSourceTime(), &envelope.SourceTime},
+		{msg.GetFetchTime(), &envelope.FetchTime},
+		{msg.GetPublishedAt(), &envelope.PublishedAt},
+	}
+	for _, t := range times {
+		if t.value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339Nano, t.value)
+		if err != nil {
+			return nil, err
+		}
+		*t.target = parsed
+	}
+	return envelope, nil
+}
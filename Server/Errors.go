@@ -0,0 +1,114 @@
+package Server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// Suggested wait before retrying after a dependency outage
+const defaultRetryAfter = 5 * time.Second
+
+// ErrorKind classifies service errors by what the client should do about them
+type ErrorKind int
+
+const (
+	// KindInternal is a bug or unexpected failure on the server
+	KindInternal ErrorKind = iota
+	// KindInvalidArgument means the request must be fixed before retrying
+	KindInvalidArgument
+	// KindNotFound means the requested resource, such as a currency, does not exist
+	KindNotFound
+	// KindUnavailable means a dependency is down and the call may be retried later
+	KindUnavailable
+)
+
+// Error is a classified service error
+type Error struct {
+	Kind ErrorKind
+	// Op names the operation that failed, e.g. "fetch price"
+	Op  string
+	Err error
+	// RetryAfter is suggested to the client for unavailable errors
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %v", e.Op, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Map the error to a gRPC status, with retry info where a retry makes sense
+func (e *Error) GRPCStatus() *status.Status {
+	var code codes.Code
+	switch e.Kind {
+	case KindInvalidArgument:
+		code = codes.InvalidArgument
+	case KindNotFound:
+		code = codes.NotFound
+	case KindUnavailable:
+		code = codes.Unavailable
+	default:
+		// Internal details are logged, not returned
+		return status.New(codes.Internal, e.Op+" failed")
+	}
+
+	st := status.New(code, e.Error())
+	if e.RetryAfter > 0 {
+		if detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(e.RetryAfter)}); err == nil {
+			return detailed
+		}
+	}
+	return st
+}
+
+// Create an error for a dependency outage
+func Unavailable(op string, err error, retryAfter time.Duration) *Error {
+	return &Error{Kind: KindUnavailable, Op: op, Err: err, RetryAfter: retryAfter}
+}
+
+// Create an error for a missing resource
+func NotFound(op string, err error) *Error {
+	return &Error{Kind: KindNotFound, Op: op, Err: err}
+}
+
+// Create an error for a bad request
+func InvalidArgument(op string, err error) *Error {
+	return &Error{Kind: KindInvalidArgument, Op: op, Err: err}
+}
+
+// Create an error for an unexpected failure
+func Internal(op string, err error) *Error {
+	return &Error{Kind: KindInternal, Op: op, Err: err}
+}
+
+// Convert any error to one carrying a gRPC status
+func ToStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var serviceErr *Error
+	if errors.As(err, &serviceErr) {
+		return serviceErr.GRPCStatus().Err()
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	switch {
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	return status.Error(codes.Internal, "internal error")
+}
@@ -0,0 +1,140 @@
+package Server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+const frankfurterURL = "https://api.frankfurter.app"
+
+// FXRateSource provides fiat exchange rates
+type FXRateSource interface {
+	// Rate returns how many units of quote one unit of base is worth
+	Rate(ctx context.Context, base string, quote string) (float64, error)
+}
+
+// StaticFXRates serves fixed rates from one base currency, e.g. for tests or pinned deployments
+type StaticFXRates struct {
+	Base  string
+	Rates map[string]float64
+}
+
+func (fx *StaticFXRates) Rate(ctx context.Context, base string, quote string) (float64, error) {
+	if base == quote {
+		return 1, nil
+	}
+	rate, ok := fx.Rates[quote]
+	if base != fx.Base || !ok {
+		return 0, NotFound("convert price", fmt.Errorf("no FX rate for %s/%s", base, quote))
+	}
+	return rate, nil
+}
+
+type cachedRates struct {
+	rates     map[string]float64
+	fetchedAt time.Time
+}
+
+// HTTPFXRates fetches reference rates from a Frankfurter compatible API and caches them
+type HTTPFXRates struct {
+	URL    string
+	Client *http.Client
+	TTL    time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cachedRates
+}
+
+var defaultFXSource = sync.OnceValue(func() FXRateSource { return NewHTTPFXRates() })
+
+// The FX source shared by every publisher, so they share one cache
+func DefaultFXSource() FXRateSource {
+	return defaultFXSource()
+}
+
+// Create the HTTP FX source configured from FX_SOURCE_URL and FX_CACHE_TTL
+func NewHTTPFXRates() *HTTPFXRates {
+	baseURL := os.Getenv("FX_SOURCE_URL")
+	if baseURL == "" {
+		baseURL = frankfurterURL // default value
+	}
+
+	return &HTTPFXRates{
+		URL:    baseURL,
+		Client: &http.Client{Timeout: envDuration("PRICE_SOURCE_TIMEOUT", 5*time.Second)},
+		TTL:    envDuration("FX_CACHE_TTL", time.Hour),
+		cache:  map[string]cachedRates{},
+	}
+}
+
+func (fx *HTTPFXRates) Rate(ctx context.Context, base string, quote string) (float64, error) {
+	if base == quote {
+		return 1, nil
+	}
+
+	rates, err := fx.ratesFor(ctx, base)
+	if err != nil {
+		return 0, err
+	}
+	rate, ok := rates[quote]
+	if !ok {
+		return 0, NotFound("convert price", fmt.Errorf("no FX rate for %s/%s", base, quote))
+	}
+	return rate, nil
+}
+
+// Return the rates from the base currency, refreshing them once they are older than the TTL.
+// Stale rates are served when a refresh fails.
+func (fx *HTTPFXRates) ratesFor(ctx context.Context, base string) (map[string]float64, error) {
+	fx.mu.Lock()
+	cached, ok := fx.cache[base]
+	fx.mu.Unlock()
+	if ok && time.Since(cached.fetchedAt) < fx.TTL {
+		return cached.rates, nil
+	}
+
+	rates, err := fx.fetch(ctx, base)
+	if err != nil {
+		if ok {
+			loggerFromContext(ctx).Warn("serving stale FX rates", "base", base, "error", err)
+			return cached.rates, nil
+		}
+		return nil, err
+	}
+
+	fx.mu.Lock()
+	fx.cache[base] = cachedRates{rates: rates, fetchedAt: time.Now()}
+	fx.mu.Unlock()
+	return rates, nil
+}
+
+// Fetch the latest rates from the base currency
+func (fx *HTTPFXRates) fetch(ctx context.Context, base string) (map[string]float64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fx.URL+"/latest?from="+url.QueryEscape(base), nil)
+	if err != nil {
+		return nil, Internal("fetch FX rates", err)
+	}
+	resp, err := fx.Client.Do(req)
+	if err != nil {
+		return nil, Unavailable("fetch FX rates", err, defaultRetryAfter)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, Unavailable("fetch FX rates", fmt.Errorf("FX source returned %s", resp.Status), defaultRetryAfter)
+	}
+
+	var data struct {
+		Rates map[string]float64 `json:"rates"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, Unavailable("fetch FX rates", fmt.Errorf("failed to decode response: %w", err), defaultRetryAfter)
+	}
+	return data.Rates, nil
+}
@@ -0,0 +1,515 @@
+package Server
+
+import (
+	pricepb "BTCPrice/protofiles"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// How old the last published tick may be to serve as the latest price
+const maxLatestAge = 3 * tickRate
+
+// Gateway serves the price service as REST/JSON and live ticks as Server-Sent Events,
+// with the same authentication, validation and rate limits as the gRPC server
+type Gateway struct {
+	Server *Server
+	// Auth authenticates requests; nil accepts anonymous ones
+	Auth    Authenticator
+	Limiter *RateLimiter
+	History *HistoricalData
+}
+
+// Create a new gateway in front of the server
+func NewGateway(server *Server, auth Authenticator, limiter *RateLimiter) (*Gateway, error) {
+	history, err := NewHistoricalData()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to Redis: %v", err)
+	}
+	return &Gateway{Server: server, Auth: auth, Limiter: limiter, History: history}, nil
+}
+
+// gatewayPrice is the JSON form of a price
+type gatewayPrice struct {
+	Asset      string  `json:"asset"`
+	Currency   string  `json:"currency"`
+	Timedate   string  `json:"timedate"`
+	Price      float64 `json:"price"`
+	Source     string  `json:"source,omitempty"`
+	SourceTime string  `json:"source_time,omitempty"`
+	FetchTime  string  `json:"fetch_time,omitempty"`
+	Sequence   uint64  `json:"sequence,omitempty"`
+	TickID     string  `json:"tick_id,omitempty"`
+}
+
+func newGatewayPrice(res *pricepb.SubscribeResponse) gatewayPrice {
+	return gatewayPrice{
+		Asset:      res.GetAsset(),
+		Currency:   res.GetCurrency(),
+		Timedate:   res.GetTimedate(),
+		Price:      res.GetPrice(),
+		Source:     res.GetSource(),
+		SourceTime: res.GetSourceTime(),
+		FetchTime:  res.GetFetchTime(),
+		Sequence:   res.GetSequence(),
+		TickID:     res.GetTickId(),
+	}
+}
+
+// The HTTP routes of the gateway
+func (g *Gateway) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/currencies", g.handle(g.currencies))
+	mux.HandleFunc("/v1/price", g.handle(g.latestPrice))
+	mux.HandleFunc("/v1/history", g.handle(g.history))
+	mux.HandleFunc("/v1/stream", g.handle(g.stream))
+	mux.HandleFunc("/v1/ws", g.handle(g.websocket))
+	return mux
+}
+
+// Wrap a handler with method checks, authentication and error reporting
+func (g *Gateway) handle(handler func(ctx context.Context, w http.ResponseWriter, r *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write(statusJSON(status.New(codes.Unimplemented, "only GET is supported")))
+			return
+		}
+
+		ctx, err := g.authenticate(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if err := handler(ctx, w, r); err != nil {
+			loggerFromContext(ctx).Info("gateway request failed", "path", r.URL.Path, "error", err)
+			writeError(w, ToStatus(err))
+		}
+	}
+}
+
+// Authenticate the request the way the gRPC interceptors do, from the same
+// headers and the verified client certificate
+func (g *Gateway) authenticate(r *http.Request) (context.Context, error) {
+	md := metadata.MD{}
+	if key := r.Header.Get(apiKeyHeader); key != "" {
+		md.Set(apiKeyHeader, key)
+	}
+	if authorization := r.Header.Get(authorizationHeader); authorization != "" {
+		md.Set(authorizationHeader, authorization)
+	}
+	// Browsers cannot set headers on WebSocket requests, so they may pass the credentials in the query
+	if websocket.IsWebSocketUpgrade(r) {
+		query := r.URL.Query()
+		if key := query.Get("api_key"); key != "" && len(md.Get(apiKeyHeader)) == 0 {
+			md.Set(apiKeyHeader, key)
+		}
+		if token := query.Get("access_token"); token != "" && len(md.Get(authorizationHeader)) == 0 {
+			md.Set(authorizationHeader, "Bearer "+token)
+		}
+	}
+
+	p := &peer.Peer{Addr: remoteAddr(r.RemoteAddr)}
+	if r.TLS != nil {
+		p.AuthInfo = credentials.TLSInfo{State: *r.TLS}
+	}
+	ctx := peer.NewContext(metadata.NewIncomingContext(r.Context(), md), p)
+
+	if g.Auth == nil {
+		return ctx, nil
+	}
+	return authenticate(ctx, g.Auth)
+}
+
+// remoteAddr is the address of an HTTP client
+type remoteAddr string
+
+func (a remoteAddr) Network() string { return "tcp" }
+func (a remoteAddr) String() string  { return string(a) }
+
+// GET /v1/currencies?asset=ETH lists the currencies and assets
+func (g *Gateway) currencies(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	res, err := g.Server.ListCurrencies(ctx, &pricepb.ListCurrenciesRequest{Asset: r.URL.Query().Get("asset")})
+	if err != nil {
+		return err
+	}
+	return writeProto(w, res)
+}
+
+// GET /v1/price?currency=USD&asset=BTC returns the last published price, which is the same on every replica
+func (g *Gateway) latestPrice(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	query := r.URL.Query()
+	asset, currency, err := g.validatePair(query.Get("asset"), query.Get("currency"))
+	if err != nil {
+		return err
+	}
+	if g.Server.Authorizer != nil {
+		if err := g.Server.Authorizer.AuthorizeHistory(ctx, currency, time.Time{}); err != nil {
+			return err
+		}
+	}
+
+	if err := g.Limiter.AllowPrice(RateLimitKey(ctx)); err != nil {
+		return err
+	}
+
+	// Only the leader asks the price sources, so a stale price means the poller is behind rather than a reason to ask them here
+	latest, err := g.History.Latest(ctx, asset, currency)
+	if err != nil {
+		return err
+	}
+	if latest == nil {
+		return Unavailable("load the latest price", fmt.Errorf("no %s price in %s was published yet", asset, currency), defaultRetryAfter)
+	}
+	if at, err := time.Parse(time.RFC3339, latest.GetTimedate()); err != nil || time.Since(at) > maxLatestAge {
+		return Unavailable("load the latest price", fmt.Errorf("the last %s price in %s, from %s, is stale", asset, currency, latest.GetTimedate()), defaultRetryAfter)
+	}
+	return writeJSON(w, newGatewayPrice(latest))
+}
+
+// GET /v1/history?currency=USD&start=2024-01-01T00:00:00Z&asset=BTC returns the cached prices since the start time
+func (g *Gateway) history(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	query := r.URL.Query()
+	asset, currency, err := g.validatePair(query.Get("asset"), query.Get("currency"))
+	if err != nil {
+		return err
+	}
+	startTime, violation := g.Server.validator().ValidateStartTime("start", query.Get("start"))
+	if violation == nil && startTime.IsZero() {
+		violation = &errdetails.BadRequest_FieldViolation{Field: "start", Description: "is required"}
+	}
+	if violation != nil {
+		return invalidArgument([]*errdetails.BadRequest_FieldViolation{violation})
+	}
+
+	if g.Server.Authorizer != nil {
+		if err := g.Server.Authorizer.AuthorizeHistory(ctx, currency, startTime); err != nil {
+			return err
+		}
+	}
+	if err := g.Limiter.AllowHistory(RateLimitKey(ctx)); err != nil {
+		return err
+	}
+
+	keys, err := g.History.RetrievePriceFromRedis(ctx, asset, currency, startTime.Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	prices := []gatewayPrice{}
+	for _, res := range g.History.LoadPrices(ctx, asset, currency, keys) {
+		prices = append(prices, newGatewayPrice(res))
+	}
+	return writeJSON(w, map[string][]gatewayPrice{"prices": prices})
+}
+
+// GET /v1/stream?currencies=USD,EUR&start=...&asset=BTC streams ticks as Server-Sent Events,
+// through the same subscription as the gRPC Subscribe call
+func (g *Gateway) stream(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return Internal("stream prices", fmt.Errorf("response writer does not support flushing"))
+	}
+
+	query := r.URL.Query()
+	req := &pricepb.SubscribeRequest{Asset: query.Get("asset"), StartTime: query.Get("start")}
+	for _, value := range query["currencies"] {
+		req.Currencies = append(req.Currencies, strings.Split(value, ",")...)
+	}
+	if err := parseThrottle(query, req); err != nil {
+		return err
+	}
+	// A reconnecting EventSource resumes after the last tick it received in each currency.
+	// It reconnects to the same URL, so the resume replaces the start time.
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		resumeAfter, err := parseEventCursor(id, req.GetAsset())
+		if err != nil {
+			return err
+		}
+		req.ResumeAfter = resumeAfter
+		req.StartTime = ""
+	}
+
+	client := RateLimitKey(ctx)
+	release, err := g.Limiter.AcquireStream(client)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if req.GetStartTime() != "" || len(req.GetResumeAfter()) > 0 {
+		if err := g.Limiter.AllowHistory(client); err != nil {
+			return err
+		}
+	}
+
+	stream := &sseStream{ctx: ctx, w: w, flusher: flusher}
+	err = g.Server.Subscribe(req, stream)
+	if err == nil {
+		return nil
+	}
+	if !stream.startedEvents() {
+		return err
+	}
+	// The events have started, so the error can only be reported as one
+	stream.sendEvent("error", statusJSON(status.Convert(err)))
+	return nil
+}
+
+// Read the sequence number to resume each currency after from an event ID, a comma separated list of tick IDs
+func parseEventCursor(id string, requestedAsset string) (map[string]uint64, error) {
+	resumeAfter := map[string]uint64{}
+	for _, tickID := range strings.Split(id, ",") {
+		asset, currency, sequence, err := ParseTickID(tickID)
+		if err != nil {
+			return nil, invalidArgument([]*errdetails.BadRequest_FieldViolation{{Field: "Last-Event-ID", Description: err.Error()}})
+		}
+		// Sequence numbers are counted per asset, so they cannot resume another asset's stream
+		if requested := normalizeCurrency(requestedAsset); asset != requested && (requested != "" || asset != DefaultAsset) {
+			return nil, invalidArgument([]*errdetails.BadRequest_FieldViolation{{Field: "Last-Event-ID", Description: fmt.Sprintf("tick %q is not of the requested asset", tickID)}})
+		}
+		resumeAfter[currency] = sequence
+	}
+	return resumeAfter, nil
+}
+
+// Read the min_interval, min_change and min_change_percent query parameters into the request
+func parseThrottle(query url.Values, req *pricepb.SubscribeRequest) error {
+	var violations []*errdetails.BadRequest_FieldViolation
+	if value := query.Get("min_interval"); value != "" {
+		seconds, err := strconv.ParseInt(value, 10, 32)
+		if err != nil {
+			violations = append(violations, &errdetails.BadRequest_FieldViolation{Field: "min_interval", Description: "must be a number of seconds"})
+		}
+		req.MinIntervalSeconds = int32(seconds)
+	}
+	for field, target := range map[string]*float64{"min_change": &req.MinChange, "min_change_percent": &req.MinChangePercent} {
+		if value := query.Get(field); value != "" {
+			number, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				violations = append(violations, &errdetails.BadRequest_FieldViolation{Field: field, Description: "must be a number"})
+			}
+			*target = number
+		}
+	}
+
+	if len(violations) > 0 {
+		return invalidArgument(violations)
+	}
+	return nil
+}
+
+// Validate the asset and currency query parameters
+func (g *Gateway) validatePair(asset string, currency string) (string, string, error) {
+	var violations []*errdetails.BadRequest_FieldViolation
+	asset, violation := g.Server.validator().ValidateAsset("asset", asset)
+	if violation != nil {
+		violations = append(violations, violation)
+	}
+	currency, violation = g.Server.validator().ValidateCurrency("currency", currency)
+	if violation != nil {
+		violations = append(violations, violation)
+	}
+	if len(violations) > 0 {
+		return "", "", invalidArgument(violations)
+	}
+	return asset, currency, nil
+}
+
+// sseStream adapts an HTTP response to a Subscribe stream, writing each price as an event
+type sseStream struct {
+	ctx     context.Context
+	w       http.ResponseWriter
+	flusher http.Flusher
+
+	mu      sync.Mutex
+	started bool
+	// cursor has the last tick ID sent in each currency
+	cursor map[string]string
+}
+
+func (s *sseStream) Send(res *pricepb.SubscribeResponse) error {
+	if res.GetHeartbeat() {
+		return s.sendComment("heartbeat")
+	}
+	body, err := json.Marshal(newGatewayPrice(res))
+	if err != nil {
+		return err
+	}
+	return s.sendEventWithID("price", s.advance(res), body)
+}
+
+// Record the price's tick and return the event ID with the last tick of every currency,
+// so a reconnecting client resumes each of them
+func (s *sseStream) advance(res *pricepb.SubscribeResponse) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if res.GetTickId() != "" {
+		if s.cursor == nil {
+			s.cursor = map[string]string{}
+		}
+		s.cursor[res.GetCurrency()] = res.GetTickId()
+	}
+	currencies := make([]string, 0, len(s.cursor))
+	for currency := range s.cursor {
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+	ids := make([]string, 0, len(currencies))
+	for _, currency := range currencies {
+		ids = append(ids, s.cursor[currency])
+	}
+	return strings.Join(ids, ",")
+}
+
+// Write an event, sending the event stream headers first
+func (s *sseStream) sendEvent(event string, data []byte) error {
+	return s.sendEventWithID(event, "", data)
+}
+
+// Write an event with an ID, which the client sends back as Last-Event-ID when it reconnects
+func (s *sseStream) sendEventWithID(event string, id string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.startLocked()
+	if id != "" {
+		if _, err := fmt.Fprintf(s.w, "id: %s\n", id); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+// Write a comment, which keeps the connection alive without an event for the client
+func (s *sseStream) sendComment(comment string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.startLocked()
+	if _, err := fmt.Fprintf(s.w, ": %s\n\n", comment); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+// Send the event stream headers, unless they were sent already
+func (s *sseStream) startLocked() {
+	if !s.started {
+		s.started = true
+		s.w.Header().Set("Content-Type", "text/event-stream")
+		s.w.Header().Set("Cache-Control", "no-cache")
+		s.w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (s *sseStream) startedEvents() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.started
+}
+
+func (s *sseStream) Context() context.Context     { return s.ctx }
+func (s *sseStream) SetHeader(metadata.MD) error  { return nil }
+func (s *sseStream) SendHeader(metadata.MD) error { return nil }
+func (s *sseStream) SetTrailer(metadata.MD)       {}
+func (s *sseStream) RecvMsg(m interface{}) error  { return io.EOF }
+
+func (s *sseStream) SendMsg(m interface{}) error {
+	res, ok := m.(*pricepb.SubscribeResponse)
+	if !ok {
+		return fmt.Errorf("unexpected message %T", m)
+	}
+	return s.Send(res)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(v)
+}
+
+func writeProto(w http.ResponseWriter, m proto.Message) error {
+	body, err := protojson.Marshal(m)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(body)
+	return err
+}
+
+// The JSON form of a status, as used by Google's HTTP APIs
+func statusJSON(st *status.Status) []byte {
+	body, err := protojson.Marshal(st.Proto())
+	if err != nil {
+		return []byte(`{"message":"internal error"}`)
+	}
+	return body
+}
+
+// Write a status error as JSON with the matching HTTP status, and Retry-After when the client should wait
+func writeError(w http.ResponseWriter, err error) {
+	st := status.Convert(err)
+	for _, detail := range st.Details() {
+		if retry, ok := detail.(*errdetails.RetryInfo); ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.GetRetryDelay().AsDuration().Seconds()))))
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatusFromCode(st.Code()))
+	w.Write(statusJSON(st))
+}
+
+// Map a gRPC code to an HTTP status
+func httpStatusFromCode(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.InvalidArgument, codes.OutOfRange, codes.FailedPrecondition:
+		return http.StatusBadRequest
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Canceled:
+		return 499
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
@@ -3,24 +3,62 @@ package Server
 import (
 	pricepb "BTCPrice/protofiles"
 	"context"
-	"log"
+	"encoding/json"
+	"errors"
 	"os"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/go-redis/redis/v8"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const separator = "@"
 const redisKey = "times"
 
+const (
+	defaultHistoryRetention = 24 * time.Hour
+	// Ticks indexed by sequence number, twice those of the resume window in case ticks come faster
+	maxSequencedTicks = 2 * int64(resumeWindow/tickRate)
+)
+
+// ErrDeposed means a newer leader was elected, so the tick must not be numbered or published
+var ErrDeposed = errors.New("a newer leader was elected")
+
+// Number the tick only if the fencing token is still the newest one
+var fencedIncrScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return -1
+end
+return redis.call("INCR", KEYS[2])
+`)
+
 type HistoricalData struct {
 	RedisClient *redis.Client
+	// Retention is how long the cached prices are kept; zero uses the default of 24h
+	Retention time.Duration
 }
 
-// Create a new historical data instance
+// Create a new historical data instance keeping the prices for HISTORY_RETENTION (default 24h)
 func NewHistoricalData() (*HistoricalData, error) {
+	return &HistoricalData{
+		RedisClient: NewRedisClient(),
+		Retention:   envDuration("HISTORY_RETENTION", defaultHistoryRetention),
+	}, nil
+}
+
+// The retention, or the default one when unset
+func (hist *HistoricalData) retention() time.Duration {
+	if hist.Retention <= 0 {
+		return defaultHistoryRetention
+	}
+	return hist.Retention
+}
+
+// Create a new Redis client from the environment
+func NewRedisClient() *redis.Client {
 	redisAddr := os.Getenv("REDIS_ADDR")
 	if redisAddr == "" {
 		redisAddr = "redis:6379" // default value
@@ -37,48 +75,98 @@ func NewHistoricalData() (*HistoricalData, error) {
 		db = 0 // default value
 	}
 
-	redis := redis.NewClient(&redis.Options{
+	return redis.NewClient(&redis.Options{
 		Addr:     redisAddr,
 		Password: redisPassword,
 		DB:       db,
 	})
-
-	return &HistoricalData{RedisClient: redis}, nil
 }
 
 // Retrieve the BTC price from the cache
-func (hist *HistoricalData) RetrieveBTCPriceRedis(currency string, timedate string, stream pricepb.PriceService_SubscribeServer) error {
-	ctx := context.Background()
-	keys, err := hist.RetrievePriceFromRedis(ctx, currency, timedate)
+func (hist *HistoricalData) RetrieveBTCPriceRedis(ctx context.Context, currency string, timedate string, stream pricepb.PriceService_SubscribeServer) error {
+	return hist.RetrievePriceHistory(ctx, DefaultAsset, currency, timedate, stream)
+}
+
+// Retrieve the asset price from the cache and send it to the client
+func (hist *HistoricalData) RetrievePriceHistory(ctx context.Context, asset string, currency string, timedate string, stream pricepb.PriceService_SubscribeServer) error {
+	keys, err := hist.RetrievePriceFromRedis(ctx, asset, currency, timedate)
 	if err != nil {
 		return err
 	}
-	return hist.SendPricesToClient(ctx, currency, keys, stream)
+	return hist.SendPricesToClient(ctx, asset, currency, keys, stream)
 }
 
-// Retrieve the BTC price from the cache
-func (hist *HistoricalData) RetrievePriceFromRedis(ctx context.Context, currency string, timedate string) ([]string, error) {
+// Redis sorted set indexing the cached prices of the asset by time.
+// Bitcoin keeps the original unprefixed keys.
+func timesKey(asset string) string {
+	if asset == DefaultAsset {
+		return redisKey
+	}
+	return redisKey + ":" + asset
+}
+
+// Prefix of the cached price keys of the asset and currency
+func priceKeyPrefix(asset string, currency string) string {
+	if asset == DefaultAsset {
+		return currency
+	}
+	return asset + ":" + currency
+}
+
+// Counter of the sequence numbers of the asset and currency
+func sequenceKey(asset string, currency string) string {
+	return "seq:" + queueName(asset, currency)
+}
+
+// Redis sorted set indexing the cached prices of the asset and currency by sequence number
+func sequencesKey(asset string, currency string) string {
+	return sequenceKey(asset, currency) + ":ticks"
+}
+
+// A cached tick with a sequence number. Ticks without one are cached as the bare price.
+type cachedTick struct {
+	Price    float64 `json:"price"`
+	Sequence uint64  `json:"sequence"`
+	TickID   string  `json:"tick_id"`
+}
+
+// Retrieve the keys of the cached prices since timedate
+func (hist *HistoricalData) RetrievePriceFromRedis(ctx context.Context, asset string, currency string, timedate string) ([]string, error) {
 	//priceKey := currency + "@" + timedate
 	// Parse the timedate from the request
 	reqTimedate, err := time.Parse(time.RFC3339, timedate)
 	if err != nil {
-		log.Printf("Invalid timedate: %v", err)
+		loggerFromContext(ctx).Warn("invalid timedate", "timedate", timedate, "error", err)
+		return nil, InvalidArgument("retrieve history", err)
+	}
+
+	return hist.keysBetween(ctx, asset, currency, reqTimedate, time.Now())
+}
+
+// Load the cached prices between the times, both included, oldest first
+func (hist *HistoricalData) LoadHistory(ctx context.Context, asset string, currency string, from time.Time, to time.Time) ([]*pricepb.SubscribeResponse, error) {
+	keys, err := hist.keysBetween(ctx, asset, currency, from, to)
+	if err != nil {
 		return nil, err
 	}
+	return hist.LoadPrices(ctx, asset, currency, keys), nil
+}
 
-	priceKeys, err := hist.RedisClient.ZRangeByScore(ctx, "times", &redis.ZRangeBy{
-		Min: strconv.FormatInt(reqTimedate.Unix(), 10),
-		Max: strconv.FormatInt(time.Now().Unix(), 10),
+// The keys of the cached prices of the currency between the times
+func (hist *HistoricalData) keysBetween(ctx context.Context, asset string, currency string, from time.Time, to time.Time) ([]string, error) {
+	priceKeys, err := hist.RedisClient.ZRangeByScore(ctx, timesKey(asset), &redis.ZRangeBy{
+		Min: strconv.FormatInt(from.Unix(), 10),
+		Max: strconv.FormatInt(to.Unix(), 10),
 	}).Result()
 	if err != nil {
-		log.Printf("Error fetching times: %v", err)
-		return nil, err
+		loggerFromContext(ctx).Error("error fetching times", "error", err)
+		return nil, Unavailable("retrieve history", err, defaultRetryAfter)
 	}
 
 	// Filter the keys to only include those for the requested currency
 	var filteredKeys []string
 	for _, key := range priceKeys {
-		if strings.HasPrefix(key, currency+separator) {
+		if strings.HasPrefix(key, priceKeyPrefix(asset, currency)+separator) {
 			filteredKeys = append(filteredKeys, key)
 		}
 	}
@@ -87,43 +175,151 @@ func (hist *HistoricalData) RetrievePriceFromRedis(ctx context.Context, currency
 }
 
 // Send the prices to the client
-func (hist *HistoricalData) SendPricesToClient(ctx context.Context, currency string, keys []string, stream pricepb.PriceService_SubscribeServer) error {
+func (hist *HistoricalData) SendPricesToClient(ctx context.Context, asset string, currency string, keys []string, stream pricepb.PriceService_SubscribeServer) error {
+	for _, res := range hist.LoadPrices(ctx, asset, currency, keys) {
+		if err := tracedSend(ctx, stream, res); err != nil {
+			loggerFromContext(ctx).Error("error sending response", "error", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Load the cached prices of the keys, skipping the ones that cannot be read
+func (hist *HistoricalData) LoadPrices(ctx context.Context, asset string, currency string, keys []string) []*pricepb.SubscribeResponse {
+	logger := loggerFromContext(ctx)
+
 	// For each key, retrieve the price from the cache
+	prices := make([]*pricepb.SubscribeResponse, 0, len(keys))
 	for _, key := range keys {
 		priceStr, err := hist.RedisClient.Get(ctx, key).Result()
 		if err != nil {
-			log.Printf("Error fetching price for %s: %v", key, err)
+			logger.Warn("error fetching price", "key", key, "error", err)
 			continue
 		}
 
-		// Convert priceStr to float64
-		priceFloat, err := strconv.ParseFloat(priceStr, 64)
+		var tick cachedTick
+		if strings.HasPrefix(priceStr, "{") {
+			err = json.Unmarshal([]byte(priceStr), &tick)
+		} else {
+			tick.Price, err = strconv.ParseFloat(priceStr, 64)
+		}
 		if err != nil {
-			log.Printf("Error converting price to float64: %v", err)
+			logger.Warn("error converting price to float64", "key", key, "error", err)
 			continue
 		}
 
-		res := &pricepb.SubscribeResponse{
+		prices = append(prices, &pricepb.SubscribeResponse{
 			Currency: currency,
 			Timedate: strings.Split(key, separator)[1],
-			Price:    priceFloat,
-		}
-		if err := stream.Send(res); err != nil {
-			log.Printf("Error sending response: %v", err)
-			return err
+			Price:    tick.Price,
+			Asset:    asset,
+			Sequence: tick.Sequence,
+			TickId:   tick.TickID,
+		})
+	}
+
+	return prices
+}
+
+// Assign the next sequence number of the asset and currency, shared by every replica.
+// With a fencing token, the number is only assigned while fenceKey holds that token, and ErrDeposed is returned otherwise.
+func (hist *HistoricalData) NextSequence(ctx context.Context, asset string, currency string, fenceKey string, token int64) (uint64, error) {
+	var sequence int64
+	var err error
+	if token > 0 && fenceKey != "" {
+		sequence, err = fencedIncrScript.Run(ctx, hist.RedisClient, []string{fenceKey, sequenceKey(asset, currency)}, token).Int64()
+	} else {
+		sequence, err = hist.RedisClient.Incr(ctx, sequenceKey(asset, currency)).Result()
+	}
+	if err != nil {
+		return 0, Unavailable("assign a sequence number", err, defaultRetryAfter)
+	}
+	if sequence < 0 {
+		return 0, ErrDeposed
+	}
+	return uint64(sequence), nil
+}
+
+// Load the cached prices after the sequence number and no older than since, oldest first
+func (hist *HistoricalData) LoadSince(ctx context.Context, asset string, currency string, after uint64, since time.Time) ([]*pricepb.SubscribeResponse, error) {
+	keys, err := hist.RedisClient.ZRangeByScore(ctx, sequencesKey(asset, currency), &redis.ZRangeBy{
+		Min: "(" + strconv.FormatUint(after, 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, Unavailable("retrieve history", err, defaultRetryAfter)
+	}
+
+	var prices []*pricepb.SubscribeResponse
+	for _, res := range hist.LoadPrices(ctx, asset, currency, keys) {
+		if at, err := time.Parse(time.RFC3339, res.GetTimedate()); err == nil && at.Before(since.Truncate(time.Second)) {
+			continue
 		}
+		prices = append(prices, res)
 	}
+	return prices, nil
+}
 
-	return nil
+// Load the cached price with the highest sequence number, or nil when there is none
+func (hist *HistoricalData) Latest(ctx context.Context, asset string, currency string) (*pricepb.SubscribeResponse, error) {
+	keys, err := hist.RedisClient.ZRevRange(ctx, sequencesKey(asset, currency), 0, 0).Result()
+	if err != nil {
+		return nil, Unavailable("retrieve the latest price", err, defaultRetryAfter)
+	}
+	prices := hist.LoadPrices(ctx, asset, currency, keys)
+	if len(prices) == 0 {
+		return nil, nil
+	}
+	return prices[0], nil
 }
 
 // Cache the price in Redis
-func (hist *HistoricalData) CachePrice(ctx context.Context, currency string, timedate time.Time, price float64) error {
+func (hist *HistoricalData) CachePrice(ctx context.Context, asset string, currency string, timedate time.Time, price float64) error {
+	return hist.CacheTick(ctx, &Price{Asset: asset, Currency: currency, Time: timedate, Price: price})
+}
+
+// Cache the tick in Redis for the retention, indexed by time and, when it has one, by sequence number.
+// The indexes are trimmed as they grow.
+func (hist *HistoricalData) CacheTick(ctx context.Context, tick *Price) error {
+	ctx, span := tracer.Start(ctx, "redis.cache", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("asset", tick.Asset), attribute.String("currency", tick.Currency)))
+	defer span.End()
+
+	var value interface{} = tick.Price
+	if tick.Sequence > 0 {
+		encoded, err := json.Marshal(cachedTick{Price: tick.Price, Sequence: tick.Sequence, TickID: tick.TickID})
+		if err != nil {
+			return recordError(span, err)
+		}
+		value = encoded
+	}
+
 	// Store the price and timedate in the cache for future use
-	timedateStr := timedate.Format(time.RFC3339)
-	priceKey := currency + separator + timedateStr
-	hist.RedisClient.Set(ctx, priceKey, price, 0)
-	hist.RedisClient.ZAdd(ctx, redisKey, &redis.Z{Score: float64(timedate.Unix()), Member: priceKey})
+	timedateStr := tick.Time.Format(time.RFC3339)
+	priceKey := priceKeyPrefix(tick.Asset, tick.Currency) + separator + timedateStr
+	if err := hist.RedisClient.Set(ctx, priceKey, value, hist.retention()).Err(); err != nil {
+		return recordError(span, err)
+	}
+	if err := hist.RedisClient.ZAdd(ctx, timesKey(tick.Asset), &redis.Z{Score: float64(tick.Time.Unix()), Member: priceKey}).Err(); err != nil {
+		return recordError(span, err)
+	}
+	expired := strconv.FormatInt(tick.Time.Add(-hist.retention()).Unix(), 10)
+	if err := hist.RedisClient.ZRemRangeByScore(ctx, timesKey(tick.Asset), "-inf", "("+expired).Err(); err != nil {
+		return recordError(span, err)
+	}
+	if tick.Sequence > 0 {
+		key := sequencesKey(tick.Asset, tick.Currency)
+		if err := hist.RedisClient.ZAdd(ctx, key, &redis.Z{Score: float64(tick.Sequence), Member: priceKey}).Err(); err != nil {
+			return recordError(span, err)
+		}
+		// Only resuming and the latest price use this index
+		oldest := int64(tick.Sequence) - maxSequencedTicks
+		if err := hist.RedisClient.ZRemRangeByScore(ctx, key, "-inf", "("+strconv.FormatInt(oldest, 10)).Err(); err != nil {
+			return recordError(span, err)
+		}
+	}
 
 	return nil
 }
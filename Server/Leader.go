@@ -0,0 +1,172 @@
+package Server
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	defaultLeaderKey   = "leader:poller"
+	defaultLeaderLease = 5 * time.Second
+)
+
+// Take the lock if it is free, and start a new term with the next fencing token
+var acquireScript = redis.NewScript(`
+if redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+	return redis.call("INCR", KEYS[2])
+end
+return 0
+`)
+
+// Extend the lease if the lock is still ours
+var renewScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// Free the lock if it is still ours
+var releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// LeaderElector elects one replica at a time through a Redis lock with a lease.
+// Each term has a fencing token greater than those of the terms before it.
+type LeaderElector struct {
+	Client *redis.Client
+	// Key of the lock; the fencing tokens are counted in Key + ":token"
+	Key string
+	// ID identifies the replica holding the lock
+	ID string
+	// Lease is how long the lock outlives a leader that stopped renewing it; zero uses the default of 5s
+	Lease time.Duration
+}
+
+// Create an elector on the client with the LEADER_LEASE lease (default 5s), named after the host
+func NewLeaderElectorFromEnv(client *redis.Client) *LeaderElector {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return &LeaderElector{
+		Client: client,
+		Key:    defaultLeaderKey,
+		ID:     host + "-" + newSubscriptionID(),
+		Lease:  envDuration("LEADER_LEASE", defaultLeaderLease),
+	}
+}
+
+// The key holding the newest fencing token
+func (e *LeaderElector) TokenKey() string {
+	return e.Key + ":token"
+}
+
+// The lease, or the default one when unset
+func (e *LeaderElector) lease() time.Duration {
+	if e.Lease <= 0 {
+		return defaultLeaderLease
+	}
+	return e.Lease
+}
+
+// Campaign until the context is done, running lead while this replica is the leader.
+// The context passed to lead is cancelled when the lease is lost, and the lock is
+// released once lead returns, so another replica takes over without waiting for the lease.
+func (e *LeaderElector) Run(ctx context.Context, lead func(ctx context.Context, token int64)) {
+	logger := loggerFromContext(ctx).With("replica", e.ID)
+	interval := e.lease() / 3
+
+	for {
+		token, err := acquireScript.Run(ctx, e.Client, []string{e.Key, e.TokenKey()}, e.ID, e.lease().Milliseconds()).Int64()
+		if err != nil && ctx.Err() == nil {
+			logger.Warn("failed to campaign for leadership", "error", err)
+		}
+		if token > 0 {
+			logger.Info("elected leader", "fencing_token", token)
+			isLeader.Set(1)
+			e.lead(contextWithLogger(ctx, logger), token, lead)
+			isLeader.Set(0)
+			logger.Info("stepped down as leader", "fencing_token", token)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Run lead for one term, renewing the lease until it is lost or the context is done
+func (e *LeaderElector) lead(ctx context.Context, token int64, lead func(ctx context.Context, token int64)) {
+	logger := loggerFromContext(ctx)
+	termCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		lead(termCtx, token)
+	}()
+
+	defer func() {
+		cancel()
+		<-done
+		// The context may be done, but the lock should still be freed
+		if err := releaseScript.Run(context.Background(), e.Client, []string{e.Key}, e.ID).Err(); err != nil {
+			logger.Warn("failed to release leadership", "error", err)
+		}
+	}()
+
+	// Step down before the lease runs out when it cannot be renewed
+	renewed := time.Now()
+	interval := e.lease() / 3
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-done:
+			return
+		case <-tick.C:
+		}
+
+		held, err := renewScript.Run(ctx, e.Client, []string{e.Key}, e.ID, e.lease().Milliseconds()).Int64()
+		switch {
+		case err == nil && held == 1:
+			renewed = time.Now()
+		case err == nil:
+			logger.Warn("lost leadership to another replica")
+			return
+		case time.Since(renewed) >= e.lease()-interval:
+			logger.Warn("failed to renew leadership, stepping down", "error", err)
+			return
+		default:
+			logger.Warn("failed to renew leadership", "error", err)
+		}
+	}
+}
+
+// LeaderFence drops the messages of a deposed leader, which carry a lower fencing
+// token than the newest leader's. Messages without a token are always admitted.
+type LeaderFence struct {
+	token int64
+}
+
+// Whether a message with the token should be delivered
+func (f *LeaderFence) Admit(token int64) bool {
+	if token == 0 {
+		return true
+	}
+	if token < f.token {
+		return false
+	}
+	f.token = token
+	return true
+}
@@ -0,0 +1,86 @@
+package Server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+const defaultMemoryQueueSize = 100
+
+// MemoryBroker carries the prices over channels, for a single server and for tests
+type MemoryBroker struct {
+	// QueueSize limits the messages waiting for each subscriber; zero uses the default of 100
+	QueueSize int
+
+	mu sync.Mutex
+	// The channels of the subscribers of each topic
+	subscribers map[string]map[chan *BrokerMessage]bool
+	closed      bool
+}
+
+// Create an in-process broker
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{subscribers: map[string]map[chan *BrokerMessage]bool{}}
+}
+
+// Publish a message to the current subscribers. A subscriber that is QueueSize messages behind misses it.
+func (b *MemoryBroker) Publish(ctx context.Context, topic string, msg *BrokerMessage) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return Unavailable("publish a message", fmt.Errorf("broker is closed"), defaultRetryAfter)
+	}
+	for ch := range b.subscribers[topic] {
+		select {
+		case ch <- msg:
+		default:
+			loggerFromContext(ctx).Warn("subscriber queue is full, dropping message", "topic", topic)
+		}
+	}
+	return nil
+}
+
+// Receive the messages of the topic until the context is done
+func (b *MemoryBroker) Subscribe(ctx context.Context, topic string) (<-chan *BrokerMessage, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil, Unavailable("register a consumer", fmt.Errorf("broker is closed"), defaultRetryAfter)
+	}
+	if b.subscribers == nil {
+		b.subscribers = map[string]map[chan *BrokerMessage]bool{}
+	}
+	if b.subscribers[topic] == nil {
+		b.subscribers[topic] = map[chan *BrokerMessage]bool{}
+	}
+
+	size := b.QueueSize
+	if size <= 0 {
+		size = defaultMemoryQueueSize
+	}
+	ch := make(chan *BrokerMessage, size)
+	b.subscribers[topic][ch] = true
+
+	go func() {
+		<-ctx.Done()
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subscribers[topic], ch)
+		if len(b.subscribers[topic]) == 0 {
+			delete(b.subscribers, topic)
+		}
+		close(ch)
+	}()
+	return ch, nil
+}
+
+// Close the broker. Subscriptions end with their contexts.
+func (b *MemoryBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	return nil
+}
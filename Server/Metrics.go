@@ -0,0 +1,57 @@
+package Server
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	sourceRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "btcprice_source_requests_total",
+		Help: "Requests to upstream price sources by outcome.",
+	}, []string{"source", "outcome"})
+
+	sourceRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "btcprice_source_request_duration_seconds",
+		Help:    "Latency of requests to upstream price sources.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"source"})
+
+	breakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "btcprice_circuit_breaker_state",
+		Help: "State of the circuit breaker around each upstream source: 0 closed, 1 open, 2 half-open.",
+	}, []string{"source"})
+
+	webhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "btcprice_webhook_deliveries_total",
+		Help: "Webhook delivery attempts by outcome: delivered, retried or dead_lettered.",
+	}, []string{"outcome"})
+
+	amqpPublishes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "btcprice_amqp_publishes_total",
+		Help: "Messages published to RabbitMQ by outcome: confirmed, nacked, returned for want of subscribers, timeout, failed or dropped from a full retry buffer.",
+	}, []string{"outcome"})
+
+	unconfirmedMessages = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "btcprice_amqp_unconfirmed_messages",
+		Help: "Messages buffered for publishing that RabbitMQ has not confirmed yet.",
+	})
+
+	isLeader = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "btcprice_leader",
+		Help: "1 while this replica is the leader polling the price sources, 0 otherwise.",
+	})
+
+	subscriberDrops = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "btcprice_subscriber_dropped_total",
+		Help: "Prices dropped or conflated for subscribers that fell behind, by overflow policy.",
+	}, []string{"policy"})
+)
+
+// Serve the Prometheus metrics
+func MetricsHandler() http.Handler {
+	return promhttp.Handler()
+}
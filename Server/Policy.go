@@ -0,0 +1,202 @@
+package Server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const errorDomain = "btcprice"
+
+// Duration is a time.Duration read from JSON strings such as "24h"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string: %v", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Policy describes what the clients of a tier are entitled to. Zero values mean unlimited.
+type Policy struct {
+	AllowedCurrencies []string `json:"allowed_currencies"`
+	MaxHistory        Duration `json:"max_history"`
+	MaxStreams        int      `json:"max_streams"`
+}
+
+// PolicyConfig assigns clients to tiers
+type PolicyConfig struct {
+	Tiers       map[string]Policy `json:"tiers"`
+	Clients     map[string]string `json:"clients"`
+	DefaultTier string            `json:"default_tier"`
+}
+
+// Authorizer enforces the entitlements of the calling principal
+type Authorizer struct {
+	config  PolicyConfig
+	mu      sync.Mutex
+	streams map[string]int
+}
+
+// Create a new authorizer
+func NewAuthorizer(config PolicyConfig) (*Authorizer, error) {
+	for client, tier := range config.Clients {
+		if _, ok := config.Tiers[tier]; !ok {
+			return nil, fmt.Errorf("client %s is assigned to unknown tier %s", client, tier)
+		}
+	}
+	if _, ok := config.Tiers[config.DefaultTier]; !ok {
+		return nil, fmt.Errorf("unknown default tier %q", config.DefaultTier)
+	}
+	return &Authorizer{config: config, streams: map[string]int{}}, nil
+}
+
+// Load the authorizer from a JSON policy file
+func LoadAuthorizer(path string) (*Authorizer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy file: %v", err)
+	}
+
+	var config PolicyConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse policy file: %v", err)
+	}
+
+	return NewAuthorizer(config)
+}
+
+// Look up the tier and policy of the principal in the context.
+// Unknown and anonymous callers get the default tier.
+func (auth *Authorizer) policyFor(ctx context.Context) (string, string, Policy) {
+	clientID := ""
+	if principal, ok := PrincipalFromContext(ctx); ok {
+		clientID = principal.ID
+	}
+
+	tier, ok := auth.config.Clients[clientID]
+	if !ok {
+		tier = auth.config.DefaultTier
+	}
+	return clientID, tier, auth.config.Tiers[tier]
+}
+
+// Check that the caller may subscribe to the currencies from the start time,
+// and reserve one of its streams. The returned function releases the stream.
+func (auth *Authorizer) AuthorizeSubscribe(ctx context.Context, currencies []string, startTime time.Time) (func(), error) {
+	_, tier, policy := auth.policyFor(ctx)
+
+	for _, currency := range currencies {
+		if err := authorizeCurrency(tier, policy, currency); err != nil {
+			return nil, err
+		}
+	}
+	if err := authorizeHistory(tier, policy, startTime); err != nil {
+		return nil, err
+	}
+
+	// The session running the subscription already holds its stream
+	if ctx.Value(heldStreamKey{}) != nil {
+		return func() {}, nil
+	}
+	return auth.AcquireStream(ctx)
+}
+
+type heldStreamKey struct{}
+
+// Mark the subscriptions run under the context as sharing a stream already reserved by AcquireStream
+func contextWithHeldStream(ctx context.Context) context.Context {
+	return context.WithValue(ctx, heldStreamKey{}, true)
+}
+
+// Reserve one of the caller's streams. The returned function releases the stream.
+func (auth *Authorizer) AcquireStream(ctx context.Context) (func(), error) {
+	clientID, tier, policy := auth.policyFor(ctx)
+
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+	if policy.MaxStreams > 0 && auth.streams[clientID] >= policy.MaxStreams {
+		return nil, permissionDenied("STREAM_LIMIT_EXCEEDED", tier,
+			fmt.Sprintf("concurrent stream limit of %d reached for tier %s", policy.MaxStreams, tier))
+	}
+	auth.streams[clientID]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			auth.mu.Lock()
+			defer auth.mu.Unlock()
+			if auth.streams[clientID]--; auth.streams[clientID] <= 0 {
+				delete(auth.streams, clientID)
+			}
+		})
+	}, nil
+}
+
+// Check that the caller may read history from the start time
+func (auth *Authorizer) AuthorizeHistory(ctx context.Context, currency string, startTime time.Time) error {
+	_, tier, policy := auth.policyFor(ctx)
+	if err := authorizeCurrency(tier, policy, currency); err != nil {
+		return err
+	}
+	return authorizeHistory(tier, policy, startTime)
+}
+
+// Check that the caller may set alerts on the currency
+func (auth *Authorizer) AuthorizeAlert(ctx context.Context, currency string) error {
+	_, tier, policy := auth.policyFor(ctx)
+	return authorizeCurrency(tier, policy, currency)
+}
+
+func authorizeCurrency(tier string, policy Policy, currency string) error {
+	if len(policy.AllowedCurrencies) == 0 {
+		return nil
+	}
+	for _, allowed := range policy.AllowedCurrencies {
+		if strings.EqualFold(allowed, currency) {
+			return nil
+		}
+	}
+	return permissionDenied("CURRENCY_NOT_ALLOWED", tier,
+		fmt.Sprintf("currency %s is not allowed for tier %s", currency, tier))
+}
+
+func authorizeHistory(tier string, policy Policy, startTime time.Time) error {
+	if policy.MaxHistory <= 0 || startTime.IsZero() {
+		return nil
+	}
+	if time.Since(startTime) > time.Duration(policy.MaxHistory) {
+		return permissionDenied("HISTORY_DEPTH_EXCEEDED", tier,
+			fmt.Sprintf("start time is more than %s in the past, the history limit for tier %s", time.Duration(policy.MaxHistory), tier))
+	}
+	return nil
+}
+
+// Build a PermissionDenied error naming the rule that failed
+func permissionDenied(reason string, tier string, message string) error {
+	st := status.New(codes.PermissionDenied, message)
+	detailed, err := st.WithDetails(&errdetails.ErrorInfo{
+		Reason:   reason,
+		Domain:   errorDomain,
+		Metadata: map[string]string{"tier": tier},
+	})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
@@ -0,0 +1,84 @@
+package Server
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Poller fetches every asset once per tick and publishes its price in every currency.
+// Only the leader runs it, so the load on the price sources does not grow with the replicas.
+type Poller struct {
+	// Publishers has one publisher per asset
+	Publishers []*Publisher
+	Currencies []string
+	// Interval between ticks; zero uses the default of 5s
+	Interval time.Duration
+	// FenceKey is the key of the newest fencing token, checked before each tick is numbered
+	FenceKey string
+}
+
+// Create a poller of the supported assets and currencies, publishing with the server's broker, alerts and webhooks
+func (serv *Server) NewPoller() (*Poller, error) {
+	poller := &Poller{Currencies: serv.validator().Supported(), Interval: tickRate}
+	for _, asset := range serv.validator().Assets() {
+		publisher, err := serv.createPublisher(context.Background(), asset, "")
+		if err != nil {
+			poller.Close()
+			return nil, err
+		}
+		poller.Publishers = append(poller.Publishers, publisher)
+	}
+	return poller, nil
+}
+
+// Publish the prices on every tick until the context is done, marking them with the fencing token
+func (p *Poller) Run(ctx context.Context, token int64) {
+	for _, publisher := range p.Publishers {
+		publisher.FencingToken = token
+		publisher.FenceKey = p.FenceKey
+	}
+
+	interval := p.Interval
+	if interval <= 0 {
+		interval = tickRate
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	// A new leader publishes right away rather than a tick later
+	for {
+		p.poll(ctx, time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// Fetch and publish every asset's prices for one tick
+func (p *Poller) poll(ctx context.Context, timedate time.Time) {
+	var wg sync.WaitGroup
+	for _, publisher := range p.Publishers {
+		wg.Add(1)
+		go func(publisher *Publisher) {
+			defer wg.Done()
+			if err := publisher.FetchAndPublishPrices(ctx, p.Currencies, timedate); err != nil {
+				loggerFromContext(ctx).Error("error fetching price", "asset", publisher.asset(), "error", err)
+			}
+		}(publisher)
+	}
+	wg.Wait()
+}
+
+// Close the publishers
+func (p *Poller) Close() error {
+	var err error
+	for _, publisher := range p.Publishers {
+		if closeErr := publisher.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
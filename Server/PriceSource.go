@@ -0,0 +1,187 @@
+package Server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const coinDeskURL = "https://api.coindesk.com/v1/bpi/currentprice.json"
+
+// PriceSource fetches quotes from one upstream API with timeouts, retries and a circuit breaker
+type PriceSource struct {
+	Name string
+	URL  string
+	// Currencies are quoted by the source directly, others are converted from BaseCurrency
+	Currencies   []string
+	BaseCurrency string
+	// Decode parses a response body; nil means the CoinDesk format
+	Decode     func(io.Reader) (*APIResponse, error)
+	Client     *http.Client
+	Breaker    *CircuitBreaker
+	MaxRetries int
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+}
+
+// errPermanent marks upstream failures that a retry will not fix
+type errPermanent struct {
+	err error
+}
+
+func (e errPermanent) Error() string { return e.err.Error() }
+func (e errPermanent) Unwrap() error { return e.err }
+
+var defaultSource = sync.OnceValue(NewCoinDeskSource)
+
+// The CoinDesk source shared by every publisher, so they share one circuit breaker
+func DefaultPriceSource() *PriceSource {
+	return defaultSource()
+}
+
+// Create the CoinDesk source configured from the environment
+func NewCoinDeskSource() *PriceSource {
+	url := os.Getenv("PRICE_SOURCE_URL")
+	if url == "" {
+		url = coinDeskURL // default value
+	}
+
+	return &PriceSource{
+		Name:         "coindesk",
+		URL:          url,
+		Currencies:   []string{"USD", "EUR", "GBP"},
+		BaseCurrency: "USD",
+		Client:       &http.Client{Timeout: envDuration("PRICE_SOURCE_TIMEOUT", 5*time.Second)},
+		Breaker:      NewCircuitBreaker("coindesk", envInt("BREAKER_FAILURE_THRESHOLD", 5), envDuration("BREAKER_OPEN_TIMEOUT", 30*time.Second)),
+		MaxRetries:   envInt("PRICE_SOURCE_RETRIES", 2),
+		BaseDelay:    200 * time.Millisecond,
+		MaxDelay:     2 * time.Second,
+	}
+}
+
+// Whether the source quotes the currency without conversion
+func (src *PriceSource) Quotes(currency string) bool {
+	for _, quoted := range src.Currencies {
+		if quoted == currency {
+			return true
+		}
+	}
+	return false
+}
+
+// Fetch the current quotes, retrying transient failures
+func (src *PriceSource) Fetch(ctx context.Context) (*APIResponse, error) {
+	if wait, err := src.Breaker.Allow(); err != nil {
+		sourceRequests.WithLabelValues(src.Name, "rejected").Inc()
+		return nil, Unavailable("fetch price", fmt.Errorf("%s: %w", src.Name, err), wait)
+	}
+
+	var err error
+	for attempt := 0; attempt <= src.MaxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(src.backoff(attempt)):
+			case <-ctx.Done():
+				src.Breaker.Abandon()
+				return nil, ctx.Err()
+			}
+		}
+
+		var data *APIResponse
+		data, err = src.fetchOnce(ctx)
+		if err == nil {
+			src.Breaker.Success()
+			return data, nil
+		}
+
+		if ctx.Err() != nil {
+			// The caller went away, which says nothing about the source
+			src.Breaker.Abandon()
+			return nil, ctx.Err()
+		}
+		loggerFromContext(ctx).Warn("price source request failed", "source", src.Name, "attempt", attempt+1, "error", err)
+		if errors.As(err, &errPermanent{}) {
+			break
+		}
+	}
+
+	src.Breaker.Failure()
+	return nil, Unavailable("fetch price", err, defaultRetryAfter)
+}
+
+// Make a single request to the source
+func (src *PriceSource) fetchOnce(ctx context.Context) (_ *APIResponse, err error) {
+	start := time.Now()
+	defer func() {
+		outcome := "success"
+		if err != nil {
+			outcome = "error"
+		}
+		sourceRequests.WithLabelValues(src.Name, outcome).Inc()
+		sourceRequestDuration.WithLabelValues(src.Name).Observe(time.Since(start).Seconds())
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src.URL, nil)
+	if err != nil {
+		return nil, errPermanent{err}
+	}
+	resp, err := src.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("%s returned %s", src.Name, resp.Status)
+		// Server errors and throttling are worth retrying, other client errors are not
+		if resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			return nil, errPermanent{err}
+		}
+		return nil, err
+	}
+
+	decode := src.Decode
+	if decode == nil {
+		decode = decodeCoinDesk
+	}
+	data, err := decode(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	data.FetchedAt = time.Now()
+
+	return data, nil
+}
+
+// Decode a CoinDesk current price response
+func decodeCoinDesk(body io.Reader) (*APIResponse, error) {
+	var data APIResponse
+	if err := json.NewDecoder(body).Decode(&data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// Exponential backoff with full jitter for the given retry attempt
+func (src *PriceSource) backoff(attempt int) time.Duration {
+	return jitteredBackoff(src.BaseDelay, src.MaxDelay, attempt)
+}
+
+// Exponential backoff with full jitter before the given retry
+func jitteredBackoff(base time.Duration, maxDelay time.Duration, attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	delay := base << (attempt - 1)
+	if delay <= 0 || delay > maxDelay {
+		delay = maxDelay
+	}
+	return time.Duration(rand.Int63n(int64(delay) + 1))
+}
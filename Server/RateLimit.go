@@ -0,0 +1,295 @@
+package Server
+
+import (
+	pricepb "BTCPrice/protofiles"
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+const (
+	retryAfterHeader = "retry-after"
+	limiterIdleTTL   = 10 * time.Minute
+)
+
+// RateLimitConfig configures the per-client token buckets and the global stream cap
+type RateLimitConfig struct {
+	StreamsPerMinute     float64
+	StreamBurst          int
+	HistoryPerMinute     float64
+	HistoryBurst         int
+	PricePerMinute       float64
+	PriceBurst           int
+	UnaryPerMinute       float64
+	UnaryBurst           int
+	MaxConcurrentStreams int
+	// RetryAfter is suggested to clients rejected by the global cap
+	RetryAfter time.Duration
+}
+
+// Read the rate limit configuration from the environment
+func RateLimitConfigFromEnv() RateLimitConfig {
+	return RateLimitConfig{
+		StreamsPerMinute:     envFloat("RATE_LIMIT_STREAMS_PER_MINUTE", 30),
+		StreamBurst:          envInt("RATE_LIMIT_STREAM_BURST", 10),
+		HistoryPerMinute:     envFloat("RATE_LIMIT_HISTORY_PER_MINUTE", 10),
+		HistoryBurst:         envInt("RATE_LIMIT_HISTORY_BURST", 5),
+		PricePerMinute:       envFloat("RATE_LIMIT_PRICE_PER_MINUTE", 60),
+		PriceBurst:           envInt("RATE_LIMIT_PRICE_BURST", 10),
+		UnaryPerMinute:       envFloat("RATE_LIMIT_UNARY_PER_MINUTE", 120),
+		UnaryBurst:           envInt("RATE_LIMIT_UNARY_BURST", 20),
+		MaxConcurrentStreams: envInt("MAX_CONCURRENT_STREAMS", 1000),
+		RetryAfter:           5 * time.Second,
+	}
+}
+
+// RateLimitError reports a rejected call and when it may be retried
+type RateLimitError struct {
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", e.Reason, e.RetryAfter)
+}
+
+// Convert the error to a ResourceExhausted status with retry info
+func (e *RateLimitError) GRPCStatus() *status.Status {
+	st := status.New(codes.ResourceExhausted, e.Error())
+	detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(e.RetryAfter)})
+	if err != nil {
+		return st
+	}
+	return detailed
+}
+
+// Metadata telling the client how many seconds to wait
+func (e *RateLimitError) retryAfterMD() metadata.MD {
+	return metadata.Pairs(retryAfterHeader, strconv.Itoa(int(math.Ceil(e.RetryAfter.Seconds()))))
+}
+
+type limiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// RateLimiter holds the token buckets of every client and the global stream count
+type RateLimiter struct {
+	config    RateLimitConfig
+	mu        sync.Mutex
+	streams   map[string]*limiterEntry
+	history   map[string]*limiterEntry
+	prices    map[string]*limiterEntry
+	unary     map[string]*limiterEntry
+	active    int
+	lastPrune time.Time
+}
+
+// Create a new rate limiter
+func NewRateLimiter(config RateLimitConfig) *RateLimiter {
+	return &RateLimiter{
+		config:    config,
+		streams:   map[string]*limiterEntry{},
+		history:   map[string]*limiterEntry{},
+		prices:    map[string]*limiterEntry{},
+		unary:     map[string]*limiterEntry{},
+		lastPrune: time.Now(),
+	}
+}
+
+// Take a token from the client's bucket, returning how long to wait if there is none
+func (rl *RateLimiter) take(buckets map[string]*limiterEntry, client string, perMinute float64, burst int) time.Duration {
+	now := time.Now()
+	rl.pruneLocked(now)
+
+	entry, ok := buckets[client]
+	if !ok {
+		entry = &limiterEntry{limiter: rate.NewLimiter(rate.Limit(perMinute/60), burst)}
+		buckets[client] = entry
+	}
+	entry.lastSeen = now
+
+	reservation := entry.limiter.ReserveN(now, 1)
+	if !reservation.OK() {
+		return time.Minute
+	}
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return delay
+	}
+	return 0
+}
+
+// Drop the buckets of clients that have been idle for a while
+func (rl *RateLimiter) pruneLocked(now time.Time) {
+	if now.Sub(rl.lastPrune) < time.Minute {
+		return
+	}
+	rl.lastPrune = now
+	for _, buckets := range []map[string]*limiterEntry{rl.streams, rl.history, rl.prices, rl.unary} {
+		for client, entry := range buckets {
+			if now.Sub(entry.lastSeen) > limiterIdleTTL {
+				delete(buckets, client)
+			}
+		}
+	}
+}
+
+// Admit a new stream for the client. The returned function releases its global slot.
+func (rl *RateLimiter) AcquireStream(client string) (func(), error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.config.MaxConcurrentStreams > 0 && rl.active >= rl.config.MaxConcurrentStreams {
+		return nil, &RateLimitError{Reason: "server is at its concurrent stream limit", RetryAfter: rl.config.RetryAfter}
+	}
+	if rl.config.StreamsPerMinute > 0 {
+		if delay := rl.take(rl.streams, client, rl.config.StreamsPerMinute, rl.config.StreamBurst); delay > 0 {
+			return nil, &RateLimitError{Reason: "too many new streams", RetryAfter: delay}
+		}
+	}
+	rl.active++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			rl.mu.Lock()
+			defer rl.mu.Unlock()
+			rl.active--
+		})
+	}, nil
+}
+
+// Admit a latest price query for the client
+func (rl *RateLimiter) AllowPrice(client string) error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.config.PricePerMinute <= 0 {
+		return nil
+	}
+	if delay := rl.take(rl.prices, client, rl.config.PricePerMinute, rl.config.PriceBurst); delay > 0 {
+		return &RateLimitError{Reason: "too many price queries", RetryAfter: delay}
+	}
+	return nil
+}
+
+// Admit a unary call for the client
+func (rl *RateLimiter) AllowUnary(client string) error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.config.UnaryPerMinute <= 0 {
+		return nil
+	}
+	if delay := rl.take(rl.unary, client, rl.config.UnaryPerMinute, rl.config.UnaryBurst); delay > 0 {
+		return &RateLimitError{Reason: "too many calls", RetryAfter: delay}
+	}
+	return nil
+}
+
+// Admit a history query for the client
+func (rl *RateLimiter) AllowHistory(client string) error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.config.HistoryPerMinute <= 0 {
+		return nil
+	}
+	if delay := rl.take(rl.history, client, rl.config.HistoryPerMinute, rl.config.HistoryBurst); delay > 0 {
+		return &RateLimitError{Reason: "too many history queries", RetryAfter: delay}
+	}
+	return nil
+}
+
+// Identify the client by its principal, falling back to the peer IP
+func RateLimitKey(ctx context.Context) string {
+	if principal, ok := PrincipalFromContext(ctx); ok {
+		return "principal:" + principal.ID
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		host, _, err := net.SplitHostPort(p.Addr.String())
+		if err != nil {
+			host = p.Addr.String()
+		}
+		return "ip:" + host
+	}
+	return "unknown"
+}
+
+// rateLimitedStream checks history replays and resumes requested on the stream
+type rateLimitedStream struct {
+	grpc.ServerStream
+	limiter *RateLimiter
+	client  string
+}
+
+func (s *rateLimitedStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	if req, ok := m.(*pricepb.SubscribeRequest); ok && (req.GetStartTime() != "" || len(req.GetResumeAfter()) > 0) {
+		if err := s.limiter.AllowHistory(s.client); err != nil {
+			s.SetTrailer(err.(*RateLimitError).retryAfterMD())
+			return err
+		}
+	}
+	return nil
+}
+
+// Create a stream interceptor enforcing the stream and history limits
+func StreamRateLimitInterceptor(limiter *RateLimiter) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		client := RateLimitKey(ss.Context())
+		release, err := limiter.AcquireStream(client)
+		if err != nil {
+			loggerFromContext(ss.Context()).Warn("stream rate limited", "client", client, "error", err)
+			ss.SetTrailer(err.(*RateLimitError).retryAfterMD())
+			return err
+		}
+		defer release()
+
+		return handler(srv, &rateLimitedStream{ServerStream: ss, limiter: limiter, client: client})
+	}
+}
+
+// Create a unary interceptor enforcing the per-client call limit on every method,
+// and the history limit as well on the given methods, which replay history
+func UnaryRateLimitInterceptor(limiter *RateLimiter, historyMethods ...string) grpc.UnaryServerInterceptor {
+	limited := map[string]bool{}
+	for _, method := range historyMethods {
+		limited[method] = true
+	}
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		// Health checks come from the orchestrator rather than clients
+		if strings.HasPrefix(info.FullMethod, "/grpc.health.v1.Health/") {
+			return handler(ctx, req)
+		}
+
+		client := RateLimitKey(ctx)
+		err := limiter.AllowUnary(client)
+		if err == nil && limited[info.FullMethod] {
+			err = limiter.AllowHistory(client)
+		}
+		if err != nil {
+			loggerFromContext(ctx).Warn("call rate limited", "client", client, "method", info.FullMethod, "error", err)
+			grpc.SetTrailer(ctx, err.(*RateLimitError).retryAfterMD())
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
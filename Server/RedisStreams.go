@@ -0,0 +1,263 @@
+package Server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	defaultStreamMaxLen = 1000
+	// How long a read waits for messages before reading the streams subscribed since
+	streamBlock = 2 * time.Second
+	// Entries read from the streams at once
+	streamReadCount = 100
+)
+
+// RedisStreamBroker carries the messages over one Redis stream per topic.
+// One reader per broker reads every subscribed stream and hands the entries to the subscribers.
+type RedisStreamBroker struct {
+	Client *redis.Client
+	// ReadClient is the connection the reader blocks on, apart from Client so that Publish and the cache
+	// are never short of connections; nil reads on Client
+	ReadClient *redis.Client
+	// MaxLen trims each stream to about this many messages; zero uses the default of 1000
+	MaxLen int64
+	// QueueSize limits the messages waiting for each subscriber; zero uses the default of 100
+	QueueSize int
+
+	mu sync.Mutex
+	// The subscribers of each stream
+	subscribers map[string]map[*streamSubscriber]bool
+	// ID of the last entry read from each subscribed stream
+	last map[string]string
+	// Stops the reader, which runs while there are subscribers
+	stop   context.CancelFunc
+	closed bool
+}
+
+type streamSubscriber struct {
+	ch chan *BrokerMessage
+	// ID of the last entry when the subscriber subscribed, which it does not receive
+	after string
+}
+
+// Create a Redis Streams broker on the client, reading on a connection of its own
+func NewRedisStreamBroker(client *redis.Client) *RedisStreamBroker {
+	return &RedisStreamBroker{Client: client, ReadClient: redis.NewClient(client.Options()), MaxLen: defaultStreamMaxLen}
+}
+
+// Key of the stream of the topic
+func streamKey(topic string) string {
+	return "stream:" + topic
+}
+
+// Append a message to the stream, trimming its oldest messages
+func (b *RedisStreamBroker) Publish(ctx context.Context, topic string, msg *BrokerMessage) error {
+	headers, err := json.Marshal(msg.Headers)
+	if err != nil {
+		return fmt.Errorf("failed to marshal headers: %v", err)
+	}
+
+	maxLen := b.MaxLen
+	if maxLen <= 0 {
+		maxLen = defaultStreamMaxLen
+	}
+	err = b.Client.XAdd(ctx, &redis.XAddArgs{
+		Stream: streamKey(topic),
+		MaxLen: maxLen,
+		Approx: true,
+		Values: []interface{}{
+			"id", msg.ID,
+			"content_type", msg.ContentType,
+			"schema_version", msg.SchemaVersion,
+			"type", msg.Type,
+			"timestamp", msg.Timestamp.UTC().Format(time.RFC3339Nano),
+			"headers", string(headers),
+			"body", msg.Body,
+		},
+	}).Err()
+	if err != nil {
+		return Unavailable("publish a message", err, defaultRetryAfter)
+	}
+	return nil
+}
+
+// Receive the messages added to the stream from now on, until the context is done.
+// A subscriber that is QueueSize messages behind misses the next ones.
+func (b *RedisStreamBroker) Subscribe(ctx context.Context, topic string) (<-chan *BrokerMessage, error) {
+	stream := streamKey(topic)
+
+	// Start after the entry that is last now, so nothing published after Subscribe returns is missed
+	after := "0-0"
+	entries, err := b.Client.XRevRangeN(ctx, stream, "+", "-", 1).Result()
+	if err != nil {
+		return nil, Unavailable("register a consumer", err, defaultRetryAfter)
+	}
+	if len(entries) > 0 {
+		after = entries[0].ID
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, Unavailable("register a consumer", fmt.Errorf("broker is closed"), defaultRetryAfter)
+	}
+	if b.subscribers == nil {
+		b.subscribers = map[string]map[*streamSubscriber]bool{}
+		b.last = map[string]string{}
+	}
+	if b.subscribers[stream] == nil {
+		b.subscribers[stream] = map[*streamSubscriber]bool{}
+		b.last[stream] = after
+	}
+
+	size := b.QueueSize
+	if size <= 0 {
+		size = defaultMemoryQueueSize
+	}
+	sub := &streamSubscriber{ch: make(chan *BrokerMessage, size), after: after}
+	b.subscribers[stream][sub] = true
+	if b.stop == nil {
+		readCtx, stop := context.WithCancel(context.WithoutCancel(ctx))
+		b.stop = stop
+		go b.read(readCtx)
+	}
+
+	go func() {
+		<-ctx.Done()
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subscribers[stream], sub)
+		if len(b.subscribers[stream]) == 0 {
+			delete(b.subscribers, stream)
+			delete(b.last, stream)
+		}
+		close(sub.ch)
+	}()
+	return sub.ch, nil
+}
+
+// Read the subscribed streams and hand their entries to the subscribers, until none is left.
+// A failed read is retried from the last entries read, so the subscribers miss nothing.
+func (b *RedisStreamBroker) read(ctx context.Context) {
+	client := b.ReadClient
+	if client == nil {
+		client = b.Client
+	}
+
+	for attempt := 0; ; {
+		b.mu.Lock()
+		if len(b.subscribers) == 0 || ctx.Err() != nil {
+			b.stop()
+			b.stop = nil
+			b.mu.Unlock()
+			return
+		}
+		keys := make([]string, 0, len(b.last))
+		for stream := range b.last {
+			keys = append(keys, stream)
+		}
+		sort.Strings(keys)
+		streams := append([]string{}, keys...)
+		for _, stream := range keys {
+			streams = append(streams, b.last[stream])
+		}
+		b.mu.Unlock()
+
+		result, err := client.XRead(ctx, &redis.XReadArgs{Streams: streams, Count: streamReadCount, Block: streamBlock}).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				continue
+			}
+			attempt++
+			loggerFromContext(ctx).Warn("failed to read streams", "attempt", attempt, "error", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(jitteredBackoff(100*time.Millisecond, 5*time.Second, attempt)):
+			}
+			continue
+		}
+		attempt = 0
+
+		b.mu.Lock()
+		for _, s := range result {
+			if _, subscribed := b.last[s.Stream]; !subscribed {
+				continue
+			}
+			for _, m := range s.Messages {
+				b.last[s.Stream] = m.ID
+				msg := messageFromStream(m)
+				for sub := range b.subscribers[s.Stream] {
+					if !streamIDAfter(m.ID, sub.after) {
+						continue
+					}
+					select {
+					case sub.ch <- msg:
+					default:
+						loggerFromContext(ctx).Warn("subscriber queue is full, dropping message", "stream", s.Stream)
+					}
+				}
+			}
+		}
+		b.mu.Unlock()
+	}
+}
+
+// Whether the stream entry ID, such as "1700000000000-0", comes after the other one
+func streamIDAfter(id string, other string) bool {
+	ms, seq := parseStreamID(id)
+	otherMs, otherSeq := parseStreamID(other)
+	return ms > otherMs || (ms == otherMs && seq > otherSeq)
+}
+
+func parseStreamID(id string) (uint64, uint64) {
+	msPart, seqPart, _ := strings.Cut(id, "-")
+	ms, _ := strconv.ParseUint(msPart, 10, 64)
+	seq, _ := strconv.ParseUint(seqPart, 10, 64)
+	return ms, seq
+}
+
+// Convert a stream entry to a broker message
+func messageFromStream(m redis.XMessage) *BrokerMessage {
+	field := func(name string) string {
+		value, _ := m.Values[name].(string)
+		return value
+	}
+
+	msg := &BrokerMessage{
+		ID:          field("id"),
+		ContentType: field("content_type"),
+		Type:        field("type"),
+		Body:        []byte(field("body")),
+	}
+	msg.SchemaVersion, _ = strconv.Atoi(field("schema_version"))
+	msg.Timestamp, _ = time.Parse(time.RFC3339Nano, field("timestamp"))
+	json.Unmarshal([]byte(field("headers")), &msg.Headers)
+	return msg
+}
+
+// Close the broker and its Redis clients. Subscriptions end with their contexts.
+func (b *RedisStreamBroker) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	if b.stop != nil {
+		b.stop()
+	}
+	b.mu.Unlock()
+
+	if b.ReadClient != nil && b.ReadClient != b.Client {
+		b.ReadClient.Close()
+	}
+	return b.Client.Close()
+}
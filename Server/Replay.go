@@ -0,0 +1,147 @@
+package Server
+
+import (
+	pricepb "BTCPrice/protofiles"
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// How far back a resumed subscription replays the ticks it missed
+const resumeWindow = 5 * time.Minute
+
+// ReplayCoordinator splices the history of one currency with its live ticks,
+// so a subscriber replaying from a start time gets every price once and in order
+type ReplayCoordinator struct {
+	// emit forwards a live price to the subscriber
+	emit func(context.Context, *pricepb.SubscribeResponse) error
+	// MaxHeld bounds the live ticks held back while the history is sent; zero uses the default of 64
+	MaxHeld int
+	// Policy applies once MaxHeld ticks are held: Disconnect ends the subscription, the others drop the oldest tick
+	Policy OverflowPolicy
+
+	mu        sync.Mutex
+	replaying bool
+	// Live ticks held back while the history is replayed
+	held []heldTick
+	// Time of the last price sent; older ticks are already covered
+	last time.Time
+	// Sequence number of the last price sent, which identifies ticks more precisely when they have one
+	lastSequence uint64
+}
+
+type heldTick struct {
+	ctx context.Context
+	res *pricepb.SubscribeResponse
+	at  time.Time
+}
+
+// Create a replay coordinator. When replaying, live ticks are held back until Replay has sent the history.
+func NewReplayCoordinator(replaying bool, emit func(context.Context, *pricepb.SubscribeResponse) error) *ReplayCoordinator {
+	return &ReplayCoordinator{emit: emit, replaying: replaying}
+}
+
+// Handle a live tick published at the time; ticks of unknown time are never dropped
+func (c *ReplayCoordinator) Live(ctx context.Context, res *pricepb.SubscribeResponse, at time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.replaying {
+		if limit := c.maxHeld(); len(c.held) >= limit {
+			policy := c.Policy
+			if policy == "" {
+				policy = DropOldest
+			}
+			subscriberDrops.WithLabelValues(string(policy)).Inc()
+			if policy == Disconnect {
+				return status.Errorf(codes.ResourceExhausted, "subscriber fell %d prices behind during the replay", limit)
+			}
+			// The ticks after the gap still go out in order
+			c.held = append(c.held[:0], c.held[1:]...)
+		}
+		c.held = append(c.held, heldTick{ctx: ctx, res: res, at: at})
+		return nil
+	}
+	return c.emitLocked(ctx, res, at)
+}
+
+// The bound on the held ticks, or the default one when unset
+func (c *ReplayCoordinator) maxHeld() int {
+	if c.MaxHeld <= 0 {
+		return defaultSubscriberBuffer
+	}
+	return c.MaxHeld
+}
+
+func (c *ReplayCoordinator) emitLocked(ctx context.Context, res *pricepb.SubscribeResponse, at time.Time) error {
+	if sequence := res.GetSequence(); sequence > 0 {
+		if sequence <= c.lastSequence {
+			loggerFromContext(ctx).Debug("dropped tick covered by the replay", "sequence", sequence)
+			return nil
+		}
+		c.lastSequence = sequence
+		if at = at.Truncate(time.Second); at.After(c.last) {
+			c.last = at
+		}
+		return c.emit(ctx, res)
+	}
+	if !at.IsZero() {
+		// The cached history has a resolution of one second
+		at = at.Truncate(time.Second)
+		if !at.After(c.last) {
+			loggerFromContext(ctx).Debug("dropped tick covered by the replay", "timedate", at)
+			return nil
+		}
+		c.last = at
+	}
+	return c.emit(ctx, res)
+}
+
+// Send the history loaded up to a watermark, then release the live ticks it does not cover.
+// The live ticks must already be consumed, so that none is published between the snapshot and the consumption.
+// They are held back while the history is sent, which may block on a slow subscriber.
+func (c *ReplayCoordinator) Replay(ctx context.Context, load func(watermark time.Time) ([]*pricepb.SubscribeResponse, error), send func(context.Context, *pricepb.SubscribeResponse) error) error {
+	history, err := load(time.Now())
+	if err != nil {
+		c.release()
+		return err
+	}
+
+	// Only Replay reads or writes the last price sent until the live ticks are released
+	for _, res := range history {
+		if at, err := time.Parse(time.RFC3339, res.GetTimedate()); err == nil && at.After(c.last) {
+			c.last = at
+		}
+		if res.GetSequence() > c.lastSequence {
+			c.lastSequence = res.GetSequence()
+		}
+		if err := send(ctx, res); err != nil {
+			c.release()
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	held := c.held
+	c.held = nil
+	c.replaying = false
+	for _, tick := range held {
+		if err := c.emitLocked(tick.ctx, tick.res, tick.at); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stop holding back the live ticks, dropping those held
+func (c *ReplayCoordinator) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.held = nil
+	c.replaying = false
+}
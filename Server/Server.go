@@ -3,119 +3,502 @@ package Server
 import (
 	pricepb "BTCPrice/protofiles"
 	"context"
-	"encoding/json"
-	"log"
+	"fmt"
+	"sync"
 	"time"
 
-	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
 )
 
 const tickRate = 5 * time.Second
 
 type Server struct {
 	pricepb.UnimplementedPriceServiceServer
+
+	// Authorizer enforces per-client entitlements; nil allows everything
+	Authorizer *Authorizer
+	// Validator checks incoming requests; nil uses DefaultValidator
+	Validator *Validator
+	// Alerts evaluates price alerts; nil disables the alert RPCs
+	Alerts *AlertEngine
+	// Webhooks delivers prices and alerts over HTTP; nil disables the webhook RPCs
+	Webhooks *WebhookDispatcher
+	// Backpressure bounds the prices buffered for each subscriber
+	Backpressure BackpressureConfig
+	// Broker carries the prices from the publishers to the subscribers; nil uses DefaultBroker
+	Broker Broker
+	// HistoricalData serves the replayed prices; nil connects to Redis from the environment on first use
+	HistoricalData *HistoricalData
+
+	historyOnce sync.Once
+}
+
+// The configured validator, or the default one
+func (serv *Server) validator() *Validator {
+	if serv.Validator != nil {
+		return serv.Validator
+	}
+	return DefaultValidator()
 }
 
 // Create a new publisher
-func (serv *Server) createPublisher(currency string) (*Publisher, error) {
-	publisher, err := NewPublisher(currency)
+func (serv *Server) createPublisher(ctx context.Context, asset string, currency string) (*Publisher, error) {
+	publisher, err := NewAssetPublisher(asset, currency)
 	if err != nil {
-		log.Printf("Failed to create a publisher for currency %s: %v", currency, err)
+		loggerFromContext(ctx).Error("failed to create a publisher", "error", err)
 		return nil, err
 	}
+	if serv.Broker != nil {
+		publisher.Broker = serv.Broker
+	}
+	publisher.Alerts = serv.Alerts
+	publisher.Webhooks = serv.Webhooks
 	return publisher, nil
 }
 
-// Fetch and publish the BTC price
-func (serv *Server) fetchAndPublishBTCPrice(publisher *Publisher, currency string, stream pricepb.PriceService_SubscribeServer, ctx context.Context, cancel context.CancelFunc) {
-	tick := time.NewTicker(tickRate)
-	go func() {
-		for {
-			select {
-			case <-tick.C:
-				err := publisher.FetchAndPublishBTCPrice(currency, time.Now(), stream)
-				if err != nil {
-					log.Printf("error fetching BTC price: %v", err)
-					cancel()
-					return
-				}
-			case <-ctx.Done():
-				return
-			}
+// The configured broker, or the default one
+func (serv *Server) broker() (Broker, error) {
+	if serv.Broker != nil {
+		return serv.Broker, nil
+	}
+	broker, err := DefaultBroker()
+	if err != nil {
+		return nil, Internal("register a consumer", err)
+	}
+	return broker, nil
+}
+
+// The configured cache, or one connected from the environment and shared by every subscription
+func (serv *Server) history() *HistoricalData {
+	serv.historyOnce.Do(func() {
+		if serv.HistoricalData == nil {
+			serv.HistoricalData, _ = NewHistoricalData()
 		}
-	}()
+	})
+	return serv.HistoricalData
 }
 
-// Consume messages from the queue
-func (serv *Server) consumeMessages(publisher *Publisher, currency string, stream pricepb.PriceService_SubscribeServer, ctx context.Context, cancel context.CancelFunc) {
-	msgs, err := publisher.Channel.Consume(
-		publisher.Queue.Name, // queue
-		"",                   // consumer
-		true,                 // auto-ack
-		false,                // exclusive
-		false,                // no-local
-		false,                // no-wait
-		nil,                  // args
-	)
+// Consume messages from the broker, subscribing again when the subscription is lost
+func (serv *Server) consumeMessages(broker Broker, topic string, currency string, replay *ReplayCoordinator, ctx context.Context, cancel context.CancelCauseFunc) {
+	logger := loggerFromContext(ctx)
+	msgs, err := broker.Subscribe(ctx, topic)
 	if err != nil {
-		log.Printf("Failed to register a consumer: %v", err)
+		logger.Error("failed to register a consumer", "error", err)
+		cancel(err)
 		return
 	}
 
 	go func() {
-		for d := range msgs {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				serv.unmarshalAndSendResponse(d, currency, stream, cancel)
+		fence := &LeaderFence{}
+		for attempt := 0; ; {
+			for msg := range msgs {
+				attempt = 0
+				select {
+				case <-ctx.Done():
+					return
+				default:
+					serv.unmarshalAndSendResponse(ctx, msg, currency, fence, replay, cancel)
+				}
+			}
+
+			// The subscription ended, most likely because the broker restarted
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(jitteredBackoff(time.Second, 30*time.Second, attempt)):
+				}
+				attempt++
+				if msgs, err = broker.Subscribe(ctx, topic); err == nil {
+					logger.Info("consuming again after the subscription was lost")
+					break
+				}
+				logger.Warn("failed to register a consumer", "attempt", attempt, "error", err)
 			}
 		}
 	}()
 }
 
-// Unmarshal the message and send it to the client
-func (serv *Server) unmarshalAndSendResponse(d amqp.Delivery, currency string, stream pricepb.PriceService_SubscribeServer, cancel context.CancelFunc) {
-	price := &BTCPrice{}
-	if err := json.Unmarshal(d.Body, price); err != nil {
-		log.Printf("Error unmarshalling price: %v", err)
+// Unmarshal the message and pass it on to the client
+func (serv *Server) unmarshalAndSendResponse(ctx context.Context, msg *BrokerMessage, currency string, fence *LeaderFence, replay *ReplayCoordinator, cancel context.CancelCauseFunc) {
+	logger := loggerFromContext(ctx)
+
+	// Continue the trace started by the publisher
+	ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(msg.Headers))
+	ctx, span := tracer.Start(ctx, "broker.consume", trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attribute.String("currency", currency)))
+	defer span.End()
+
+	envelope, err := DecodePriceEnvelope(msg.ContentType, msg.Body)
+	if err != nil {
+		recordError(span, err)
+		logger.Warn("error unmarshalling price", "message_id", msg.ID, "error", err)
 		return
 	}
+	if !fence.Admit(envelope.FencingToken) {
+		logger.Warn("dropped price from a deposed leader", "message_id", msg.ID, "fencing_token", envelope.FencingToken)
+		return
+	}
+	price := &envelope.Price
+
+	// The timestamps are those of the tick, not of its delivery
+	res := price.Response(currency, time.Now())
 
-	res := &pricepb.SubscribeResponse{
-		Currency: currency,
-		Timedate: time.Now().Format(time.RFC3339),
-		Price:    price.Price,
+	if err := replay.Live(ctx, res, price.Time); err != nil {
+		logger.Warn("disconnecting slow subscriber", "error", err)
+		cancel(err)
 	}
+}
 
-	if err := stream.Send(res); err != nil {
-		log.Printf("Error sending response: %v", err)
-		cancel()
-		return
+// Conflate the ticks the client asked to skip and buffer the others
+func (serv *Server) sendLive(filter *TickFilter, buffer *SubscriberBuffer) func(context.Context, *pricepb.SubscribeResponse) error {
+	return func(ctx context.Context, res *pricepb.SubscribeResponse) error {
+		if !filter.Allow(res.Price, time.Now()) {
+			loggerFromContext(ctx).Debug("conflated price update", "price", res.Price)
+			return nil
+		}
+		return buffer.Push(ctx, res)
 	}
 }
 
 // Subscribe to the price updates
 func (serv *Server) Subscribe(req *pricepb.SubscribeRequest, stream pricepb.PriceService_SubscribeServer) error {
-	currencies := req.GetCurrencies()
-	timedate := req.GetStartTime()
+	// The cause of the cancellation is what the client is told
+	ctx, cancel := context.WithCancelCause(stream.Context())
+	defer cancel(nil)
 
-	ctx, cancel := context.WithCancel(stream.Context())
-	defer cancel()
+	logger := loggerFromContext(ctx).With("subscription_id", newSubscriptionID())
+	if p, ok := peer.FromContext(ctx); ok {
+		logger = logger.With("peer", p.Addr.String())
+	}
+	if principal, ok := PrincipalFromContext(ctx); ok {
+		logger = logger.With("principal", principal.ID)
+	}
 
-	for _, currency := range currencies {
-		publisher, err := serv.createPublisher(currency)
+	params, err := serv.validator().ValidateSubscribe(req)
+	if err != nil {
+		logger.Info("invalid subscription request", "error", err)
+		return err
+	}
+	currencies := params.Currencies
+
+	if serv.Authorizer != nil {
+		// Resuming replays the ticks missed in the last few minutes, which is history too
+		historyStart := params.StartTime
+		if len(params.ResumeAfter) > 0 {
+			historyStart = time.Now().Add(-resumeWindow)
+		}
+		release, err := serv.Authorizer.AuthorizeSubscribe(ctx, currencies, historyStart)
 		if err != nil {
-			log.Fatalf("failed to create a publisher for currency %s: %v", currency, err)
+			logger.Warn("subscription denied", "error", err)
+			return err
 		}
-		defer publisher.Close()
-		publisher.HistoricalData.RetrieveBTCPriceRedis(currency, timedate, stream)
+		defer release()
+	}
+
+	logger.Info("subscription started", "asset", params.Asset, "currencies", currencies, "start_time", params.StartTime, "resume_after", params.ResumeAfter)
+	defer logger.Info("subscription ended")
 
-		serv.fetchAndPublishBTCPrice(publisher, currency, stream, ctx, cancel)
-		serv.consumeMessages(publisher, currency, stream, ctx, cancel)
+	// End the subscription once its context is done
+	end := func() error {
+		// The client going away is a normal end of the stream
+		if stream.Context().Err() != nil {
+			return nil
+		}
+		cause := context.Cause(ctx)
+		logger.Warn("subscription failed", "error", cause)
+		return ToStatus(cause)
+	}
+
+	// Everything sent to the client goes through the buffer, whose Run loop is the only sender on the stream
+	buffer := NewSubscriberBuffer(serv.Backpressure)
+	go func() {
+		if err := buffer.Run(contextWithLogger(ctx, logger), stream); err != nil {
+			logger.Error("error sending response", "error", err)
+			cancel(err)
+		}
+	}()
+	go buffer.Heartbeat(ctx)
+
+	// Subscribers only consume, from the broker the publishers share
+	broker, err := serv.broker()
+	if err != nil {
+		logger.Error("failed to configure the message broker", "error", err)
+		return ToStatus(err)
+	}
+
+	for _, currency := range currencies {
+		currencyCtx := contextWithLogger(ctx, logger.With("currency", currency))
+
+		// Live ticks are consumed from before the history snapshot and held back until it is sent,
+		// so the replay neither misses nor repeats the ticks published in between
+		resumeAfter, resuming := params.ResumeAfter[currency]
+		replaying := !params.StartTime.IsZero() || resuming
+		replay := NewReplayCoordinator(replaying, serv.sendLive(NewTickFilter(params.Throttle), buffer))
+		// A subscriber too slow to take the history holds back no more live ticks than its buffer would
+		replay.MaxHeld, replay.Policy = buffer.size, buffer.policy
+		serv.consumeMessages(broker, PriceTopic(params.Asset, currency), currency, replay, currencyCtx, cancel)
+		// A failed subscription cancels the context with the broker's error, which the client is told rather than the replay's
+		if currencyCtx.Err() != nil {
+			return end()
+		}
+		if replaying {
+			load := func(watermark time.Time) ([]*pricepb.SubscribeResponse, error) {
+				if resuming {
+					// The sequence numbers tell the live ticks apart, so there is no need for a watermark
+					return serv.history().LoadSince(currencyCtx, params.Asset, currency, resumeAfter, time.Now().Add(-resumeWindow))
+				}
+				return serv.history().LoadHistory(currencyCtx, params.Asset, currency, params.StartTime, watermark)
+			}
+			if err := replay.Replay(currencyCtx, load, buffer.PushReliable); err != nil {
+				if currencyCtx.Err() != nil {
+					return end()
+				}
+				return ToStatus(err)
+			}
+		}
 	}
 
 	<-ctx.Done()
+	return end()
+}
+
+// List the currencies and assets clients may subscribe to
+func (serv *Server) ListCurrencies(ctx context.Context, req *pricepb.ListCurrenciesRequest) (*pricepb.ListCurrenciesResponse, error) {
+	asset, violation := serv.validator().ValidateAsset("asset", req.GetAsset())
+	if violation != nil {
+		return nil, invalidArgument([]*errdetails.BadRequest_FieldViolation{violation})
+	}
+	source, ok := PriceSourceFor(asset)
+	if !ok {
+		return nil, NotFound("list currencies", fmt.Errorf("unknown asset: %s", asset))
+	}
+
+	res := &pricepb.ListCurrenciesResponse{Assets: serv.validator().Assets()}
+	for _, code := range serv.validator().Supported() {
+		info, ok := LookupCurrency(code)
+		if !ok {
+			continue
+		}
+		res.Currencies = append(res.Currencies, &pricepb.Currency{
+			Code:      info.Code,
+			Name:      info.Name,
+			Precision: int32(info.Precision),
+			Converted: !source.Quotes(code),
+		})
+	}
+	return res, nil
+}
+
+// The alert engine, or an error when alerts are disabled
+func (serv *Server) alerts() (*AlertEngine, error) {
+	if serv.Alerts == nil {
+		return nil, status.Error(codes.Unimplemented, "alerts are not enabled on this server")
+	}
+	return serv.Alerts, nil
+}
+
+// Register a price alert for the caller
+func (serv *Server) CreateAlert(ctx context.Context, req *pricepb.CreateAlertRequest) (*pricepb.Alert, error) {
+	engine, err := serv.alerts()
+	if err != nil {
+		return nil, err
+	}
+
+	alert, err := serv.validator().ValidateCreateAlert(req)
+	if err != nil {
+		return nil, err
+	}
+	if serv.Authorizer != nil {
+		if err := serv.Authorizer.AuthorizeAlert(ctx, alert.Currency); err != nil {
+			return nil, err
+		}
+	}
+
+	alert.Owner = ownerFromContext(ctx)
+	created, err := engine.Create(ctx, alert)
+	if err != nil {
+		return nil, ToStatus(err)
+	}
+	loggerFromContext(ctx).Info("alert created", "alert_id", created.ID, "owner", created.Owner)
+	return created.Proto(), nil
+}
+
+// List the caller's alerts
+func (serv *Server) ListAlerts(ctx context.Context, req *pricepb.ListAlertsRequest) (*pricepb.ListAlertsResponse, error) {
+	engine, err := serv.alerts()
+	if err != nil {
+		return nil, err
+	}
+
+	alerts, err := engine.List(ctx, ownerFromContext(ctx))
+	if err != nil {
+		return nil, ToStatus(err)
+	}
+	res := &pricepb.ListAlertsResponse{}
+	for _, alert := range alerts {
+		res.Alerts = append(res.Alerts, alert.Proto())
+	}
+	return res, nil
+}
+
+// Delete one of the caller's alerts
+func (serv *Server) DeleteAlert(ctx context.Context, req *pricepb.DeleteAlertRequest) (*pricepb.DeleteAlertResponse, error) {
+	engine, err := serv.alerts()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := engine.Delete(ctx, ownerFromContext(ctx), req.GetId()); err != nil {
+		return nil, ToStatus(err)
+	}
+	return &pricepb.DeleteAlertResponse{}, nil
+}
+
+// Stream the caller's alerts as they trigger, after the stored ones since the start time
+func (serv *Server) WatchAlerts(req *pricepb.WatchAlertsRequest, stream pricepb.PriceService_WatchAlertsServer) error {
+	ctx := stream.Context()
+	engine, err := serv.alerts()
+	if err != nil {
+		return err
+	}
+
+	startTime, violation := serv.validator().ValidateStartTime("startTime", req.GetStartTime())
+	if violation != nil {
+		return invalidArgument([]*errdetails.BadRequest_FieldViolation{violation})
+	}
+
+	owner := ownerFromContext(ctx)
+	logger := loggerFromContext(ctx).With("owner", owner)
+
+	// Watch before replaying so no event falls between the two
+	events, stop := engine.Watch(owner)
+	defer stop()
+
+	replayed := map[string]bool{}
+	if !startTime.IsZero() {
+		history, err := engine.History(ctx, owner, startTime)
+		if err != nil {
+			return ToStatus(err)
+		}
+		for _, event := range history {
+			replayed[fmt.Sprintf("%s@%d", event.Alert.ID, event.Time.UnixNano())] = true
+			if err := stream.Send(event.Proto()); err != nil {
+				return err
+			}
+		}
+	}
+
+	logger.Info("watching alerts")
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event := <-events:
+			if replayed[fmt.Sprintf("%s@%d", event.Alert.ID, event.Time.UnixNano())] {
+				continue
+			}
+			if err := stream.Send(event.Proto()); err != nil {
+				logger.Error("error sending alert", "error", err)
+				return err
+			}
+		}
+	}
+}
+
+// The webhook dispatcher, or an error when webhooks are disabled
+func (serv *Server) webhooks() (*WebhookDispatcher, error) {
+	if serv.Webhooks == nil {
+		return nil, status.Error(codes.Unimplemented, "webhooks are not enabled on this server")
+	}
+	return serv.Webhooks, nil
+}
 
-	return nil
+// Register a webhook for the caller. The response carries the signing secret.
+func (serv *Server) CreateWebhook(ctx context.Context, req *pricepb.CreateWebhookRequest) (*pricepb.Webhook, error) {
+	dispatcher, err := serv.webhooks()
+	if err != nil {
+		return nil, err
+	}
+
+	webhook, err := serv.validator().ValidateCreateWebhook(req)
+	if err != nil {
+		return nil, err
+	}
+	if serv.Authorizer != nil {
+		for _, currency := range webhook.Currencies {
+			if err := serv.Authorizer.AuthorizeAlert(ctx, currency); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	webhook.Owner = ownerFromContext(ctx)
+	created, err := dispatcher.Create(ctx, webhook)
+	if err != nil {
+		return nil, ToStatus(err)
+	}
+	loggerFromContext(ctx).Info("webhook created", "webhook_id", created.ID, "owner", created.Owner)
+
+	res := created.Proto()
+	res.Secret = created.Secret
+	return res, nil
+}
+
+// List the caller's webhooks
+func (serv *Server) ListWebhooks(ctx context.Context, req *pricepb.ListWebhooksRequest) (*pricepb.ListWebhooksResponse, error) {
+	dispatcher, err := serv.webhooks()
+	if err != nil {
+		return nil, err
+	}
+
+	webhooks, err := dispatcher.List(ctx, ownerFromContext(ctx))
+	if err != nil {
+		return nil, ToStatus(err)
+	}
+	res := &pricepb.ListWebhooksResponse{}
+	for _, webhook := range webhooks {
+		webhookRes := webhook.Proto()
+		deadLetters, err := dispatcher.DeadLetters(ctx, webhook.ID)
+		if err != nil {
+			return nil, ToStatus(err)
+		}
+		webhookRes.DeadLetters = int32(deadLetters)
+		res.Webhooks = append(res.Webhooks, webhookRes)
+	}
+	return res, nil
+}
+
+// Delete one of the caller's webhooks
+func (serv *Server) DeleteWebhook(ctx context.Context, req *pricepb.DeleteWebhookRequest) (*pricepb.DeleteWebhookResponse, error) {
+	dispatcher, err := serv.webhooks()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := dispatcher.Delete(ctx, ownerFromContext(ctx), req.GetId()); err != nil {
+		return nil, ToStatus(err)
+	}
+	return &pricepb.DeleteWebhookResponse{}, nil
+}
+
+// Redeliver the payloads one of the caller's webhooks failed to receive
+func (serv *Server) ReplayWebhook(ctx context.Context, req *pricepb.ReplayWebhookRequest) (*pricepb.ReplayWebhookResponse, error) {
+	dispatcher, err := serv.webhooks()
+	if err != nil {
+		return nil, err
+	}
+
+	delivered, failed, err := dispatcher.Replay(ctx, ownerFromContext(ctx), req.GetId())
+	if err != nil {
+		return nil, ToStatus(err)
+	}
+	return &pricepb.ReplayWebhookResponse{Delivered: int32(delivered), Failed: int32(failed)}, nil
 }
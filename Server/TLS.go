@@ -0,0 +1,172 @@
+package Server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+const certCheckInterval = 10 * time.Second
+
+// CertReloader serves the server certificate and client CA bundle from disk,
+// picking up changed files without a restart
+type CertReloader struct {
+	certFile  string
+	keyFile   string
+	caFile    string
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  map[string]time.Time
+	lastCheck time.Time
+}
+
+// Create a new certificate reloader. Client certificates are required and
+// verified against caFile when it is not empty.
+func NewCertReloader(certFile string, keyFile string, caFile string) (*CertReloader, error) {
+	reloader := &CertReloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if err := reloader.Reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// Create the server TLS configuration from TLS_CERT_FILE, TLS_KEY_FILE and
+// TLS_CLIENT_CA_FILE. A nil reloader is returned when TLS is not configured.
+func CertReloaderFromEnv() (*CertReloader, error) {
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("both TLS_CERT_FILE and TLS_KEY_FILE must be set")
+	}
+	return NewCertReloader(certFile, keyFile, os.Getenv("TLS_CLIENT_CA_FILE"))
+}
+
+// Load the certificate, key and CA bundle from disk
+func (r *CertReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %v", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if r.caFile != "" {
+		pem, err := os.ReadFile(r.caFile)
+		if err != nil {
+			return fmt.Errorf("failed to read client CA bundle: %v", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in client CA bundle")
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.clientCAs = clientCAs
+	r.modTimes = r.currentModTimes()
+	r.lastCheck = time.Now()
+	return nil
+}
+
+// Read the modification times of the watched files
+func (r *CertReloader) currentModTimes() map[string]time.Time {
+	modTimes := map[string]time.Time{}
+	for _, file := range []string{r.certFile, r.keyFile, r.caFile} {
+		if file == "" {
+			continue
+		}
+		if info, err := os.Stat(file); err == nil {
+			modTimes[file] = info.ModTime()
+		}
+	}
+	return modTimes
+}
+
+// Reload the files if any of them changed since the last load.
+// A failed reload keeps serving the previous certificate.
+func (r *CertReloader) reloadIfChanged() {
+	r.mu.Lock()
+	if time.Since(r.lastCheck) < certCheckInterval {
+		r.mu.Unlock()
+		return
+	}
+	r.lastCheck = time.Now()
+	changed := false
+	for file, modTime := range r.currentModTimes() {
+		if !modTime.Equal(r.modTimes[file]) {
+			changed = true
+		}
+	}
+	r.mu.Unlock()
+
+	if changed {
+		if err := r.Reload(); err != nil {
+			slog.Error("failed to reload TLS certificates", "error", err)
+			return
+		}
+		slog.Info("reloaded TLS certificates")
+	}
+}
+
+// Build the TLS configuration, resolved per handshake so reloads take effect on new connections
+func (r *CertReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.reloadIfChanged()
+
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*r.cert},
+				// HTTP/1.1 is offered for the gateway, gRPC negotiates h2
+				NextProtos: []string{"h2", "http/1.1"},
+			}
+			if r.clientCAs != nil {
+				config.ClientCAs = r.clientCAs
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return config, nil
+		},
+	}
+}
+
+// ClientCertAuthenticator identifies callers by the subject of their verified client certificate
+type ClientCertAuthenticator struct{}
+
+// Create a new client certificate authenticator
+func NewClientCertAuthenticator() *ClientCertAuthenticator {
+	return &ClientCertAuthenticator{}
+}
+
+func (auth *ClientCertAuthenticator) Authenticate(ctx context.Context, md metadata.MD) (*Principal, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.VerifiedChains) == 0 || len(tlsInfo.State.VerifiedChains[0]) == 0 {
+		return nil, ErrNoCredentials
+	}
+
+	subject := tlsInfo.State.VerifiedChains[0][0].Subject
+	id := subject.CommonName
+	if id == "" {
+		id = subject.String()
+	}
+	return &Principal{ID: id, Method: "mtls"}, nil
+}
@@ -0,0 +1,55 @@
+package Server
+
+import (
+	"math"
+	"time"
+)
+
+// Longest min_interval a subscription may ask for
+const maxMinInterval = time.Hour
+
+// Throttle is how often and on how large a move a subscriber wants prices
+type Throttle struct {
+	// MinInterval is the least time between two prices of a currency
+	MinInterval time.Duration
+	// MinChange is the least absolute move from the last price sent
+	MinChange float64
+	// MinChangePercent is the least move in percent from the last price sent
+	MinChangePercent float64
+}
+
+// TickFilter conflates the ticks of one currency according to a throttle.
+// It is used by a single consumer and is not safe for concurrent use.
+type TickFilter struct {
+	throttle Throttle
+	sent     bool
+	lastTime time.Time
+	last     float64
+}
+
+// Create a tick filter
+func NewTickFilter(throttle Throttle) *TickFilter {
+	return &TickFilter{throttle: throttle}
+}
+
+// Report whether the price should be sent, recording it as the last price sent if so.
+// Ticks arrive as they are published, so the price let through after a quiet interval is always the latest.
+func (f *TickFilter) Allow(price float64, at time.Time) bool {
+	if f.sent {
+		if at.Sub(f.lastTime) < f.throttle.MinInterval {
+			return false
+		}
+		change := math.Abs(price - f.last)
+		if change < f.throttle.MinChange {
+			return false
+		}
+		if f.throttle.MinChangePercent > 0 && (f.last == 0 || change/math.Abs(f.last)*100 < f.throttle.MinChangePercent) {
+			return false
+		}
+	}
+
+	f.sent = true
+	f.lastTime = at
+	f.last = price
+	return true
+}
@@ -0,0 +1,69 @@
+package Server
+
+import (
+	pricepb "BTCPrice/protofiles"
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const serviceName = "btcprice"
+
+var tracer = otel.Tracer("BTCPrice/Server")
+
+// Set up the global tracer provider and propagator.
+// Spans are exported over OTLP/gRPC when OTEL_EXPORTER_OTLP_ENDPOINT is set
+// (e.g. http://localhost:4317 for a local collector), otherwise tracing is a no-op.
+func InitTracer(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	// The exporter reads the remaining OTEL_EXPORTER_OTLP_* variables itself
+	exporter, err := otlptracegrpc.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %v", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create resource: %v", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// Record the error on the span, if any, and return it unchanged
+func recordError(span trace.Span, err error) error {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+// Send a response on the stream inside a span
+func tracedSend(ctx context.Context, stream pricepb.PriceService_SubscribeServer, res *pricepb.SubscribeResponse) error {
+	_, span := tracer.Start(ctx, "stream.Send", trace.WithAttributes(attribute.String("currency", res.Currency)))
+	defer span.End()
+
+	return recordError(span, stream.Send(res))
+}
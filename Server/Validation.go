@@ -0,0 +1,404 @@
+package Server
+
+import (
+	pricepb "BTCPrice/protofiles"
+	"fmt"
+	"math"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultMaxCurrencies = 10
+	// Start times this far ahead of the server clock are still accepted
+	maxClockSkew = time.Minute
+	// Shortest webhook secret a client may choose
+	minWebhookSecretLength = 16
+)
+
+// Validator checks and normalizes incoming requests
+type Validator struct {
+	SupportedCurrencies map[string]bool
+	SupportedAssets     map[string]bool
+	MaxCurrencies       int
+	// MaxStartAge limits how far back a start time may reach; zero means unlimited
+	MaxStartAge time.Duration
+}
+
+// SubscribeParams is a validated, normalized SubscribeRequest
+type SubscribeParams struct {
+	Asset      string
+	Currencies []string
+	// StartTime is zero when no history was requested
+	StartTime time.Time
+	// ResumeAfter has the sequence number to resume each currency after, if any
+	ResumeAfter map[string]uint64
+	Throttle    Throttle
+}
+
+// Create a new validator for the currencies
+func NewValidator(currencies []string, maxCurrencies int, maxStartAge time.Duration) *Validator {
+	supported := map[string]bool{}
+	for _, currency := range currencies {
+		if currency = normalizeCurrency(currency); currency != "" {
+			supported[currency] = true
+		}
+	}
+	return &Validator{
+		SupportedCurrencies: supported,
+		SupportedAssets:     map[string]bool{"BTC": true, "ETH": true},
+		MaxCurrencies:       maxCurrencies,
+		MaxStartAge:         maxStartAge,
+	}
+}
+
+// Create a validator from SUPPORTED_CURRENCIES, MAX_SUBSCRIBE_CURRENCIES and MAX_START_AGE.
+// Every known fiat currency is supported by default.
+func NewValidatorFromEnv() (*Validator, error) {
+	currencies := FiatCurrencyCodes() // default value
+	if value := os.Getenv("SUPPORTED_CURRENCIES"); value != "" {
+		currencies = strings.Split(value, ",")
+		for _, currency := range currencies {
+			if _, ok := LookupCurrency(normalizeCurrency(currency)); !ok {
+				return nil, fmt.Errorf("unknown currency in SUPPORTED_CURRENCIES: %q", currency)
+			}
+		}
+	}
+
+	var maxStartAge time.Duration
+	if value := os.Getenv("MAX_START_AGE"); value != "" {
+		var err error
+		if maxStartAge, err = time.ParseDuration(value); err != nil {
+			return nil, fmt.Errorf("invalid MAX_START_AGE: %v", err)
+		}
+	}
+
+	assets, err := SupportedAssetsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	v := NewValidator(currencies, envInt("MAX_SUBSCRIBE_CURRENCIES", defaultMaxCurrencies), maxStartAge)
+	v.SupportedAssets = map[string]bool{}
+	for _, asset := range assets {
+		v.SupportedAssets[asset] = true
+	}
+	return v, nil
+}
+
+// The validator used when none is configured
+func DefaultValidator() *Validator {
+	return NewValidator(FiatCurrencyCodes(), defaultMaxCurrencies, 0)
+}
+
+// Trim and upper-case a currency code
+func normalizeCurrency(currency string) string {
+	return strings.ToUpper(strings.TrimSpace(currency))
+}
+
+// List the supported currencies in order
+func (v *Validator) Supported() []string {
+	list := make([]string, 0, len(v.SupportedCurrencies))
+	for currency := range v.SupportedCurrencies {
+		list = append(list, currency)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// List the supported assets in order
+func (v *Validator) Assets() []string {
+	list := make([]string, 0, len(v.SupportedAssets))
+	for asset := range v.SupportedAssets {
+		list = append(list, asset)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// Check an asset symbol and return it normalized; an empty value selects the default asset
+func (v *Validator) ValidateAsset(field string, asset string) (string, *errdetails.BadRequest_FieldViolation) {
+	normalized := normalizeCurrency(asset)
+	if normalized == "" {
+		return DefaultAsset, nil
+	}
+	if !v.SupportedAssets[normalized] {
+		return "", &errdetails.BadRequest_FieldViolation{
+			Field:       field,
+			Description: fmt.Sprintf("unsupported asset %q, supported: %s", asset, strings.Join(v.Assets(), ", ")),
+		}
+	}
+	return normalized, nil
+}
+
+// Check a single currency code and return it normalized
+func (v *Validator) ValidateCurrency(field string, currency string) (string, *errdetails.BadRequest_FieldViolation) {
+	normalized := normalizeCurrency(currency)
+	if !v.SupportedCurrencies[normalized] {
+		reason := "only the currencies the FX provider has rates for can be priced"
+		if _, known := LookupCurrency(normalized); known {
+			reason = "it is not enabled on this server"
+		}
+		return "", &errdetails.BadRequest_FieldViolation{
+			Field:       field,
+			Description: fmt.Sprintf("unsupported currency %q, as %s; supported: %s", currency, reason, strings.Join(v.Supported(), ", ")),
+		}
+	}
+	return normalized, nil
+}
+
+// Check an RFC 3339 start time; an empty value is valid and yields the zero time
+func (v *Validator) ValidateStartTime(field string, value string) (time.Time, *errdetails.BadRequest_FieldViolation) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	startTime, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, &errdetails.BadRequest_FieldViolation{
+			Field:       field,
+			Description: fmt.Sprintf("must be an RFC 3339 timestamp such as 2006-01-02T15:04:05Z: %v", err),
+		}
+	}
+	if startTime.After(time.Now().Add(maxClockSkew)) {
+		return time.Time{}, &errdetails.BadRequest_FieldViolation{Field: field, Description: "must not be in the future"}
+	}
+	if v.MaxStartAge > 0 && time.Since(startTime) > v.MaxStartAge {
+		return time.Time{}, &errdetails.BadRequest_FieldViolation{
+			Field:       field,
+			Description: fmt.Sprintf("must not be more than %s in the past", v.MaxStartAge),
+		}
+	}
+	return startTime, nil
+}
+
+// Check the conflation options of a subscribe request
+func (v *Validator) ValidateThrottle(req *pricepb.SubscribeRequest) (Throttle, []*errdetails.BadRequest_FieldViolation) {
+	var violations []*errdetails.BadRequest_FieldViolation
+	throttle := Throttle{
+		MinInterval:      time.Duration(req.GetMinIntervalSeconds()) * time.Second,
+		MinChange:        req.GetMinChange(),
+		MinChangePercent: req.GetMinChangePercent(),
+	}
+
+	if throttle.MinInterval < 0 || throttle.MinInterval > maxMinInterval {
+		violations = append(violations, &errdetails.BadRequest_FieldViolation{
+			Field:       "min_interval_seconds",
+			Description: fmt.Sprintf("must be between 0 and %d", int(maxMinInterval.Seconds())),
+		})
+	}
+	if throttle.MinChange < 0 || math.IsNaN(throttle.MinChange) || math.IsInf(throttle.MinChange, 0) {
+		violations = append(violations, &errdetails.BadRequest_FieldViolation{Field: "min_change", Description: "must be a non-negative number"})
+	}
+	if !(throttle.MinChangePercent >= 0 && throttle.MinChangePercent <= 100) {
+		violations = append(violations, &errdetails.BadRequest_FieldViolation{Field: "min_change_percent", Description: "must be between 0 and 100"})
+	}
+	return throttle, violations
+}
+
+// Validate a subscribe request, reporting every invalid field
+func (v *Validator) ValidateSubscribe(req *pricepb.SubscribeRequest) (*SubscribeParams, error) {
+	var violations []*errdetails.BadRequest_FieldViolation
+	params := &SubscribeParams{}
+
+	asset, violation := v.ValidateAsset("asset", req.GetAsset())
+	if violation != nil {
+		violations = append(violations, violation)
+	}
+	params.Asset = asset
+
+	currencies := req.GetCurrencies()
+	switch {
+	case len(currencies) == 0:
+		violations = append(violations, &errdetails.BadRequest_FieldViolation{Field: "currencies", Description: "at least one currency is required"})
+	case v.MaxCurrencies > 0 && len(currencies) > v.MaxCurrencies:
+		violations = append(violations, &errdetails.BadRequest_FieldViolation{
+			Field:       "currencies",
+			Description: fmt.Sprintf("at most %d currencies may be requested", v.MaxCurrencies),
+		})
+	default:
+		seen := map[string]bool{}
+		for i, currency := range currencies {
+			field := fmt.Sprintf("currencies[%d]", i)
+			normalized, violation := v.ValidateCurrency(field, currency)
+			if violation != nil {
+				violations = append(violations, violation)
+				continue
+			}
+			if seen[normalized] {
+				violations = append(violations, &errdetails.BadRequest_FieldViolation{
+					Field:       field,
+					Description: fmt.Sprintf("duplicate currency %s", normalized),
+				})
+				continue
+			}
+			seen[normalized] = true
+			params.Currencies = append(params.Currencies, normalized)
+		}
+	}
+
+	startTime, violation := v.ValidateStartTime("startTime", req.GetStartTime())
+	if violation != nil {
+		violations = append(violations, violation)
+	}
+	params.StartTime = startTime
+
+	resumeAfter := req.GetResumeAfter()
+	currencies = make([]string, 0, len(resumeAfter))
+	for currency := range resumeAfter {
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+	for _, currency := range currencies {
+		field := fmt.Sprintf("resume_after[%s]", currency)
+		normalized := normalizeCurrency(currency)
+		switch {
+		case !containsValue(params.Currencies, normalized):
+			violations = append(violations, &errdetails.BadRequest_FieldViolation{Field: field, Description: "must be one of the requested currencies"})
+		case resumeAfter[currency] == 0:
+			violations = append(violations, &errdetails.BadRequest_FieldViolation{Field: field, Description: "must be a sequence number above 0"})
+		case !startTime.IsZero():
+			violations = append(violations, &errdetails.BadRequest_FieldViolation{Field: field, Description: "cannot be combined with startTime"})
+		default:
+			if params.ResumeAfter == nil {
+				params.ResumeAfter = map[string]uint64{}
+			}
+			params.ResumeAfter[normalized] = resumeAfter[currency]
+		}
+	}
+
+	throttle, throttleViolations := v.ValidateThrottle(req)
+	violations = append(violations, throttleViolations...)
+	params.Throttle = throttle
+
+	if len(violations) > 0 {
+		return nil, invalidArgument(violations)
+	}
+	return params, nil
+}
+
+// Validate a create alert request, reporting every invalid field
+func (v *Validator) ValidateCreateAlert(req *pricepb.CreateAlertRequest) (*Alert, error) {
+	var violations []*errdetails.BadRequest_FieldViolation
+	alert := &Alert{Condition: req.GetCondition(), WindowMinutes: req.GetWindowMinutes()}
+
+	asset, violation := v.ValidateAsset("asset", req.GetAsset())
+	if violation != nil {
+		violations = append(violations, violation)
+	}
+	alert.Asset = asset
+
+	currency, violation := v.ValidateCurrency("currency", req.GetCurrency())
+	if violation != nil {
+		violations = append(violations, violation)
+	}
+	alert.Currency = currency
+
+	switch req.GetCondition() {
+	case pricepb.AlertCondition_PRICE_ABOVE, pricepb.AlertCondition_PRICE_BELOW:
+		if req.GetThreshold() <= 0 {
+			violations = append(violations, &errdetails.BadRequest_FieldViolation{Field: "threshold", Description: "must be positive"})
+		}
+		alert.Threshold = req.GetThreshold()
+		alert.WindowMinutes = 0
+	case pricepb.AlertCondition_PERCENT_CHANGE:
+		if req.GetPercent() <= 0 {
+			violations = append(violations, &errdetails.BadRequest_FieldViolation{Field: "percent", Description: "must be positive"})
+		}
+		if window := time.Duration(req.GetWindowMinutes()) * time.Minute; window <= 0 || window > maxAlertWindow {
+			violations = append(violations, &errdetails.BadRequest_FieldViolation{
+				Field:       "window_minutes",
+				Description: fmt.Sprintf("must be between 1 and %d", int(maxAlertWindow.Minutes())),
+			})
+		}
+		alert.Percent = req.GetPercent()
+	default:
+		violations = append(violations, &errdetails.BadRequest_FieldViolation{
+			Field:       "condition",
+			Description: "must be one of PRICE_ABOVE, PRICE_BELOW or PERCENT_CHANGE",
+		})
+	}
+
+	if len(violations) > 0 {
+		return nil, invalidArgument(violations)
+	}
+	return alert, nil
+}
+
+// Validate a create webhook request, reporting every invalid field
+func (v *Validator) ValidateCreateWebhook(req *pricepb.CreateWebhookRequest) (*Webhook, error) {
+	var violations []*errdetails.BadRequest_FieldViolation
+	webhook := &Webhook{URL: req.GetUrl(), Secret: req.GetSecret()}
+
+	if u, err := url.Parse(req.GetUrl()); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		violations = append(violations, &errdetails.BadRequest_FieldViolation{Field: "url", Description: "must be an absolute http or https URL"})
+	}
+
+	if len(req.GetEvents()) == 0 {
+		violations = append(violations, &errdetails.BadRequest_FieldViolation{Field: "events", Description: "at least one event is required"})
+	}
+	for i, event := range req.GetEvents() {
+		switch event {
+		case pricepb.WebhookEvent_WEBHOOK_EVENT_TICK, pricepb.WebhookEvent_WEBHOOK_EVENT_ALERT:
+			if !containsValue(webhook.Events, event) {
+				webhook.Events = append(webhook.Events, event)
+			}
+		default:
+			violations = append(violations, &errdetails.BadRequest_FieldViolation{
+				Field:       fmt.Sprintf("events[%d]", i),
+				Description: "must be WEBHOOK_EVENT_TICK or WEBHOOK_EVENT_ALERT",
+			})
+		}
+	}
+
+	for i, asset := range req.GetAssets() {
+		normalized, violation := v.ValidateAsset(fmt.Sprintf("assets[%d]", i), asset)
+		if violation != nil {
+			violations = append(violations, violation)
+			continue
+		}
+		webhook.Assets = append(webhook.Assets, normalized)
+	}
+	for i, currency := range req.GetCurrencies() {
+		normalized, violation := v.ValidateCurrency(fmt.Sprintf("currencies[%d]", i), currency)
+		if violation != nil {
+			violations = append(violations, violation)
+			continue
+		}
+		webhook.Currencies = append(webhook.Currencies, normalized)
+	}
+
+	if secret := req.GetSecret(); secret != "" && len(secret) < minWebhookSecretLength {
+		violations = append(violations, &errdetails.BadRequest_FieldViolation{
+			Field:       "secret",
+			Description: fmt.Sprintf("must be at least %d characters", minWebhookSecretLength),
+		})
+	}
+
+	if len(violations) > 0 {
+		return nil, invalidArgument(violations)
+	}
+	return webhook, nil
+}
+
+// Build an InvalidArgument error with field-level details
+func invalidArgument(violations []*errdetails.BadRequest_FieldViolation) error {
+	descriptions := make([]string, 0, len(violations))
+	for _, violation := range violations {
+		descriptions = append(descriptions, violation.Field+": "+violation.Description)
+	}
+
+	st := status.New(codes.InvalidArgument, "invalid request: "+strings.Join(descriptions, "; "))
+	detailed, err := st.WithDetails(&errdetails.BadRequest{FieldViolations: violations})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
@@ -0,0 +1,361 @@
+package Server
+
+import (
+	pricepb "BTCPrice/protofiles"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+const (
+	// Events queued for a WebSocket client before it is disconnected as too slow
+	wsSendBuffer = 64
+	wsWriteWait  = 10 * time.Second
+	// Largest message a client may send
+	wsReadLimit = 4096
+)
+
+// wsRequest is a message from a WebSocket client, e.g.
+// {"type": "subscribe", "asset": "BTC", "currencies": ["USD"], "startTime": "2024-01-01T00:00:00Z"}
+type wsRequest struct {
+	// Type is "subscribe" or "unsubscribe"
+	Type       string   `json:"type"`
+	Asset      string   `json:"asset,omitempty"`
+	Currencies []string `json:"currencies"`
+	StartTime  string   `json:"startTime,omitempty"`
+	// Conflation options, as in SubscribeRequest
+	MinIntervalSeconds int32   `json:"minIntervalSeconds,omitempty"`
+	MinChange          float64 `json:"minChange,omitempty"`
+	MinChangePercent   float64 `json:"minChangePercent,omitempty"`
+	// ResumeAfter maps currencies to the sequence number of the last tick received
+	ResumeAfter map[string]uint64 `json:"resumeAfter,omitempty"`
+}
+
+// The subscribe request for the currencies
+func (r *wsRequest) proto(currencies []string) *pricepb.SubscribeRequest {
+	req := &pricepb.SubscribeRequest{
+		Asset:              r.Asset,
+		Currencies:         currencies,
+		StartTime:          r.StartTime,
+		MinIntervalSeconds: r.MinIntervalSeconds,
+		MinChange:          r.MinChange,
+		MinChangePercent:   r.MinChangePercent,
+	}
+	for currency, sequence := range r.ResumeAfter {
+		for _, requested := range currencies {
+			if normalizeCurrency(currency) == normalizeCurrency(requested) {
+				if req.ResumeAfter == nil {
+					req.ResumeAfter = map[string]uint64{}
+				}
+				req.ResumeAfter[currency] = sequence
+			}
+		}
+	}
+	return req
+}
+
+// wsEvent is a message to a WebSocket client
+type wsEvent struct {
+	// Type is "price", "subscribed", "unsubscribed" or "error"
+	Type     string `json:"type"`
+	Asset    string `json:"asset,omitempty"`
+	Currency string `json:"currency,omitempty"`
+	// Data is the SubscribeResponse of a price event
+	Data json.RawMessage `json:"data,omitempty"`
+	// Error is the status of an error event
+	Error json.RawMessage `json:"error,omitempty"`
+}
+
+// The upgrader accepting the origins in WS_ALLOWED_ORIGINS, or only same-origin requests by default
+func wsUpgrader() *websocket.Upgrader {
+	upgrader := &websocket.Upgrader{}
+	if value := os.Getenv("WS_ALLOWED_ORIGINS"); value != "" {
+		allowed := strings.Split(value, ",")
+		upgrader.CheckOrigin = func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			for _, o := range allowed {
+				if o = strings.TrimSpace(o); o == "*" || strings.EqualFold(o, origin) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	return upgrader
+}
+
+// GET /v1/ws upgrades to a WebSocket where the client subscribes and unsubscribes currencies at will.
+// Each currency runs through the same subscription as the gRPC Subscribe call,
+// and the whole session counts as one stream, as a gRPC Subscribe of all its currencies would.
+func (g *Gateway) websocket(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	client := RateLimitKey(ctx)
+	release, err := g.Limiter.AcquireStream(client)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if auth := g.Server.Authorizer; auth != nil {
+		releaseStream, err := auth.AcquireStream(ctx)
+		if err != nil {
+			return err
+		}
+		defer releaseStream()
+		ctx = contextWithHeldStream(ctx)
+	}
+
+	conn, err := wsUpgrader().Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already replied
+		loggerFromContext(ctx).Info("websocket upgrade failed", "error", err)
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	session := &wsSession{
+		gateway:       g,
+		conn:          conn,
+		client:        client,
+		ctx:           ctx,
+		cancel:        cancel,
+		out:           make(chan []byte, wsSendBuffer),
+		subscriptions: map[string]context.CancelFunc{},
+		closeCode:     websocket.CloseNormalClosure,
+	}
+	session.run()
+	return nil
+}
+
+// wsSession is one WebSocket connection and its subscriptions
+type wsSession struct {
+	gateway *Gateway
+	conn    *websocket.Conn
+	client  string
+	ctx     context.Context
+	cancel  context.CancelFunc
+	out     chan []byte
+
+	mu            sync.Mutex
+	subscriptions map[string]context.CancelFunc
+	closeCode     int
+	closeText     string
+	wg            sync.WaitGroup
+}
+
+// Serve the connection until either side closes it
+func (s *wsSession) run() {
+	logger := loggerFromContext(s.ctx)
+	logger.Info("websocket connected")
+	defer logger.Info("websocket disconnected")
+
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		s.writeLoop()
+	}()
+
+	s.readLoop()
+	s.cancel()
+	s.wg.Wait()
+	<-writerDone
+}
+
+// Read the client's requests, and its pongs to keep the connection alive
+func (s *wsSession) readLoop() {
+	pingInterval := envDuration("WS_PING_INTERVAL", 30*time.Second)
+	s.conn.SetReadLimit(wsReadLimit)
+	s.conn.SetReadDeadline(time.Now().Add(2 * pingInterval))
+	s.conn.SetPongHandler(func(string) error {
+		return s.conn.SetReadDeadline(time.Now().Add(2 * pingInterval))
+	})
+
+	for {
+		_, data, err := s.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var req wsRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			s.sendError("", "", InvalidArgument("read message", fmt.Errorf("message is not valid JSON: %v", err)))
+			continue
+		}
+		switch req.Type {
+		case "subscribe":
+			s.subscribe(&req)
+		case "unsubscribe":
+			s.unsubscribe(&req)
+		default:
+			s.sendError("", "", InvalidArgument("read message", fmt.Errorf("unknown message type %q, expected subscribe or unsubscribe", req.Type)))
+		}
+	}
+}
+
+// Write the queued events and the pings, and close the connection once the session is done
+func (s *wsSession) writeLoop() {
+	ping := time.NewTicker(envDuration("WS_PING_INTERVAL", 30*time.Second))
+	defer ping.Stop()
+	defer s.conn.Close()
+
+	for {
+		select {
+		case message := <-s.out:
+			s.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := s.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				s.cancel()
+				return
+			}
+		case <-ping.C:
+			if err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				s.cancel()
+				return
+			}
+		case <-s.ctx.Done():
+			s.mu.Lock()
+			closeMessage := websocket.FormatCloseMessage(s.closeCode, s.closeText)
+			s.mu.Unlock()
+			s.conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(wsWriteWait))
+			return
+		}
+	}
+}
+
+// Start a subscription for each requested currency not subscribed yet
+func (s *wsSession) subscribe(req *wsRequest) {
+	params, err := s.gateway.Server.validator().ValidateSubscribe(req.proto(req.Currencies))
+	if err != nil {
+		s.sendError(req.Asset, "", err)
+		return
+	}
+	if req.StartTime != "" || len(params.ResumeAfter) > 0 {
+		if err := s.gateway.Limiter.AllowHistory(s.client); err != nil {
+			s.sendError(params.Asset, "", err)
+			return
+		}
+	}
+
+	asset := params.Asset
+	for _, currency := range params.Currencies {
+		key := asset + "/" + currency
+
+		s.mu.Lock()
+		if _, ok := s.subscriptions[key]; ok || s.ctx.Err() != nil {
+			s.mu.Unlock()
+			continue
+		}
+		ctx, cancel := context.WithCancel(s.ctx)
+		s.subscriptions[key] = cancel
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		s.send(&wsEvent{Type: "subscribed", Asset: asset, Currency: currency})
+		go func(currency string) {
+			defer s.wg.Done()
+			err := s.gateway.Server.Subscribe(
+				req.proto([]string{currency}),
+				&wsStream{ctx: ctx, session: s},
+			)
+
+			s.mu.Lock()
+			if ctx.Err() == nil {
+				delete(s.subscriptions, key)
+			}
+			s.mu.Unlock()
+			cancel()
+			if err != nil {
+				s.sendError(asset, currency, err)
+			}
+		}(currency)
+	}
+}
+
+// Stop the subscriptions of the requested currencies
+func (s *wsSession) unsubscribe(req *wsRequest) {
+	asset := normalizeCurrency(req.Asset)
+	if asset == "" {
+		asset = DefaultAsset
+	}
+
+	for _, currency := range req.Currencies {
+		currency = normalizeCurrency(currency)
+		key := asset + "/" + currency
+
+		s.mu.Lock()
+		cancel, ok := s.subscriptions[key]
+		delete(s.subscriptions, key)
+		s.mu.Unlock()
+		if ok {
+			cancel()
+			s.send(&wsEvent{Type: "unsubscribed", Asset: asset, Currency: currency})
+		}
+	}
+}
+
+func (s *wsSession) sendError(asset string, currency string, err error) {
+	s.send(&wsEvent{Type: "error", Asset: asset, Currency: currency, Error: statusJSON(status.Convert(ToStatus(err)))})
+}
+
+// Queue an event for the client, disconnecting it when it does not keep up
+func (s *wsSession) send(event *wsEvent) error {
+	message, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+
+	select {
+	case s.out <- message:
+		return nil
+	default:
+		loggerFromContext(s.ctx).Warn("websocket client is too slow, disconnecting")
+		s.mu.Lock()
+		s.closeCode, s.closeText = websocket.CloseTryAgainLater, "client is too slow"
+		s.mu.Unlock()
+		s.cancel()
+		return fmt.Errorf("websocket client is too slow")
+	}
+}
+
+// wsStream adapts a WebSocket session to a Subscribe stream for one currency
+type wsStream struct {
+	ctx     context.Context
+	session *wsSession
+}
+
+func (s *wsStream) Send(res *pricepb.SubscribeResponse) error {
+	// The session's pings keep the connection alive already
+	if res.GetHeartbeat() {
+		return nil
+	}
+	data, err := protojson.Marshal(res)
+	if err != nil {
+		return err
+	}
+	return s.session.send(&wsEvent{Type: "price", Asset: res.GetAsset(), Currency: res.GetCurrency(), Data: data})
+}
+
+func (s *wsStream) Context() context.Context     { return s.ctx }
+func (s *wsStream) SetHeader(metadata.MD) error  { return nil }
+func (s *wsStream) SendHeader(metadata.MD) error { return nil }
+func (s *wsStream) SetTrailer(metadata.MD)       {}
+func (s *wsStream) RecvMsg(m interface{}) error  { return io.EOF }
+
+func (s *wsStream) SendMsg(m interface{}) error {
+	res, ok := m.(*pricepb.SubscribeResponse)
+	if !ok {
+		return fmt.Errorf("unexpected message %T", m)
+	}
+	return s.Send(res)
+}
@@ -0,0 +1,213 @@
+package Server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	webhooksRedisKey = "webhooks"
+	// Failed deliveries of a webhook are kept in the list "webhooks:deadletters:<id>"
+	deadLettersRedisKey = "webhooks:deadletters:"
+	// Failed deliveries kept per webhook
+	maxDeadLetters = 1000
+)
+
+// WebhookStore persists webhooks and the deliveries they failed to receive
+type WebhookStore interface {
+	SaveWebhook(ctx context.Context, webhook *Webhook) error
+	// DeleteWebhook removes the webhook and its dead letters
+	DeleteWebhook(ctx context.Context, id string) error
+	// LoadWebhook returns the webhook with the id, or nil when there is none
+	LoadWebhook(ctx context.Context, id string) (*Webhook, error)
+	LoadWebhooks(ctx context.Context) ([]*Webhook, error)
+	SaveDeadLetter(ctx context.Context, delivery *WebhookDelivery) error
+	// TakeDeadLetters removes and returns the dead letters of the webhook, oldest first
+	TakeDeadLetters(ctx context.Context, webhookID string) ([]*WebhookDelivery, error)
+	CountDeadLetters(ctx context.Context, webhookID string) (int, error)
+}
+
+// RedisWebhookStore keeps webhooks in the "webhooks" Redis hash and their dead letters in a list per webhook
+type RedisWebhookStore struct {
+	RedisClient *redis.Client
+}
+
+func (store *RedisWebhookStore) SaveWebhook(ctx context.Context, webhook *Webhook) error {
+	body, err := json.Marshal(webhook)
+	if err != nil {
+		return Internal("save webhook", err)
+	}
+	if err := store.RedisClient.HSet(ctx, webhooksRedisKey, webhook.ID, body).Err(); err != nil {
+		return Unavailable("save webhook", err, defaultRetryAfter)
+	}
+	return nil
+}
+
+func (store *RedisWebhookStore) DeleteWebhook(ctx context.Context, id string) error {
+	pipe := store.RedisClient.TxPipeline()
+	pipe.HDel(ctx, webhooksRedisKey, id)
+	pipe.Del(ctx, deadLettersRedisKey+id)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return Unavailable("delete webhook", err, defaultRetryAfter)
+	}
+	return nil
+}
+
+func (store *RedisWebhookStore) LoadWebhook(ctx context.Context, id string) (*Webhook, error) {
+	value, err := store.RedisClient.HGet(ctx, webhooksRedisKey, id).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, Unavailable("load webhook", err, defaultRetryAfter)
+	}
+	webhook := &Webhook{}
+	if err := json.Unmarshal([]byte(value), webhook); err != nil {
+		return nil, Internal("load webhook", fmt.Errorf("failed to unmarshal webhook %s: %v", id, err))
+	}
+	return webhook, nil
+}
+
+func (store *RedisWebhookStore) LoadWebhooks(ctx context.Context) ([]*Webhook, error) {
+	values, err := store.RedisClient.HGetAll(ctx, webhooksRedisKey).Result()
+	if err != nil {
+		return nil, Unavailable("load webhooks", err, defaultRetryAfter)
+	}
+
+	webhooks := make([]*Webhook, 0, len(values))
+	for id, value := range values {
+		webhook := &Webhook{}
+		if err := json.Unmarshal([]byte(value), webhook); err != nil {
+			return nil, Internal("load webhooks", fmt.Errorf("failed to unmarshal webhook %s: %v", id, err))
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, nil
+}
+
+func (store *RedisWebhookStore) SaveDeadLetter(ctx context.Context, delivery *WebhookDelivery) error {
+	body, err := json.Marshal(delivery)
+	if err != nil {
+		return Internal("save dead letter", err)
+	}
+
+	key := deadLettersRedisKey + delivery.WebhookID
+	pipe := store.RedisClient.TxPipeline()
+	pipe.RPush(ctx, key, body)
+	// Drop the oldest dead letters beyond the limit
+	pipe.LTrim(ctx, key, -maxDeadLetters, -1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return Unavailable("save dead letter", err, defaultRetryAfter)
+	}
+	return nil
+}
+
+func (store *RedisWebhookStore) TakeDeadLetters(ctx context.Context, webhookID string) ([]*WebhookDelivery, error) {
+	key := deadLettersRedisKey + webhookID
+	pipe := store.RedisClient.TxPipeline()
+	values := pipe.LRange(ctx, key, 0, -1)
+	pipe.Del(ctx, key)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, Unavailable("load dead letters", err, defaultRetryAfter)
+	}
+
+	deliveries := make([]*WebhookDelivery, 0, len(values.Val()))
+	for _, value := range values.Val() {
+		delivery := &WebhookDelivery{}
+		if err := json.Unmarshal([]byte(value), delivery); err != nil {
+			return nil, Internal("load dead letters", err)
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, nil
+}
+
+func (store *RedisWebhookStore) CountDeadLetters(ctx context.Context, webhookID string) (int, error) {
+	count, err := store.RedisClient.LLen(ctx, deadLettersRedisKey+webhookID).Result()
+	if err != nil {
+		return 0, Unavailable("count dead letters", err, defaultRetryAfter)
+	}
+	return int(count), nil
+}
+
+// MemoryWebhookStore keeps webhooks in memory, e.g. for tests or single instance deployments without Redis
+type MemoryWebhookStore struct {
+	mu          sync.Mutex
+	webhooks    map[string]Webhook
+	deadLetters map[string][]WebhookDelivery
+}
+
+func (store *MemoryWebhookStore) SaveWebhook(ctx context.Context, webhook *Webhook) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.webhooks == nil {
+		store.webhooks = map[string]Webhook{}
+	}
+	store.webhooks[webhook.ID] = *webhook
+	return nil
+}
+
+func (store *MemoryWebhookStore) DeleteWebhook(ctx context.Context, id string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.webhooks, id)
+	delete(store.deadLetters, id)
+	return nil
+}
+
+func (store *MemoryWebhookStore) LoadWebhook(ctx context.Context, id string) (*Webhook, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	webhook, ok := store.webhooks[id]
+	if !ok {
+		return nil, nil
+	}
+	return &webhook, nil
+}
+
+func (store *MemoryWebhookStore) LoadWebhooks(ctx context.Context) ([]*Webhook, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	webhooks := make([]*Webhook, 0, len(store.webhooks))
+	for _, webhook := range store.webhooks {
+		webhook := webhook
+		webhooks = append(webhooks, &webhook)
+	}
+	return webhooks, nil
+}
+
+func (store *MemoryWebhookStore) SaveDeadLetter(ctx context.Context, delivery *WebhookDelivery) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.deadLetters == nil {
+		store.deadLetters = map[string][]WebhookDelivery{}
+	}
+	letters := append(store.deadLetters[delivery.WebhookID], *delivery)
+	if len(letters) > maxDeadLetters {
+		letters = letters[len(letters)-maxDeadLetters:]
+	}
+	store.deadLetters[delivery.WebhookID] = letters
+	return nil
+}
+
+func (store *MemoryWebhookStore) TakeDeadLetters(ctx context.Context, webhookID string) ([]*WebhookDelivery, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	var deliveries []*WebhookDelivery
+	for _, delivery := range store.deadLetters[webhookID] {
+		delivery := delivery
+		deliveries = append(deliveries, &delivery)
+	}
+	delete(store.deadLetters, webhookID)
+	return deliveries, nil
+}
+
+func (store *MemoryWebhookStore) CountDeadLetters(ctx context.Context, webhookID string) (int, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return len(store.deadLetters[webhookID]), nil
+}
@@ -0,0 +1,565 @@
+package Server
+
+import (
+	pricepb "BTCPrice/protofiles"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Headers of every webhook request
+const (
+	WebhookIDHeader        = "X-Webhook-Id"
+	WebhookTimestampHeader = "X-Webhook-Timestamp"
+	WebhookSignatureHeader = "X-Webhook-Signature"
+)
+
+const (
+	defaultMaxWebhooks = 10
+	// Payloads waiting for a delivery worker before new ones go straight to the dead-letter record
+	webhookQueueSize = 1000
+)
+
+// Webhook is an HTTP endpoint registered to receive ticks or alerts
+type Webhook struct {
+	ID     string                 `json:"id"`
+	Owner  string                 `json:"owner"`
+	URL    string                 `json:"url"`
+	Events []pricepb.WebhookEvent `json:"events"`
+	// Empty filters match every asset or currency
+	Assets     []string  `json:"assets,omitempty"`
+	Currencies []string  `json:"currencies,omitempty"`
+	Secret     string    `json:"secret"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Whether the webhook wants the event on the asset and currency
+func (w *Webhook) matches(event pricepb.WebhookEvent, asset string, currency string) bool {
+	return containsValue(w.Events, event) &&
+		(len(w.Assets) == 0 || containsValue(w.Assets, asset)) &&
+		(len(w.Currencies) == 0 || containsValue(w.Currencies, currency))
+}
+
+func containsValue[T comparable](values []T, value T) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Convert the webhook to its protobuf form, without the secret
+func (w *Webhook) Proto() *pricepb.Webhook {
+	return &pricepb.Webhook{
+		Id:         w.ID,
+		Url:        w.URL,
+		Events:     w.Events,
+		Assets:     w.Assets,
+		Currencies: w.Currencies,
+		CreatedAt:  w.CreatedAt.Format(time.RFC3339),
+	}
+}
+
+// WebhookPayload is the JSON body posted to webhooks
+type WebhookPayload struct {
+	ID string `json:"id"`
+	// Type is "tick" or "alert"
+	Type     string        `json:"type"`
+	Asset    string        `json:"asset"`
+	Currency string        `json:"currency"`
+	Price    float64       `json:"price"`
+	Timedate time.Time     `json:"timedate"`
+	Alert    *WebhookAlert `json:"alert,omitempty"`
+}
+
+// WebhookAlert describes the alert that triggered an alert payload
+type WebhookAlert struct {
+	ID            string  `json:"id"`
+	Condition     string  `json:"condition"`
+	Threshold     float64 `json:"threshold,omitempty"`
+	Percent       float64 `json:"percent,omitempty"`
+	WindowMinutes int32   `json:"window_minutes,omitempty"`
+	ChangePercent float64 `json:"change_percent,omitempty"`
+}
+
+// WebhookDelivery is a payload on its way to a webhook, or in its dead-letter record
+type WebhookDelivery struct {
+	ID        string          `json:"id"`
+	WebhookID string          `json:"webhook_id"`
+	Payload   json.RawMessage `json:"payload"`
+	Attempts  int             `json:"attempts"`
+	LastError string          `json:"last_error,omitempty"`
+	FailedAt  time.Time       `json:"failed_at"`
+}
+
+// Sign a webhook body the way receivers should verify it:
+// hex HMAC-SHA256 of the timestamp header, a dot and the body
+func SignWebhookPayload(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Check the signature header of a webhook request
+func VerifyWebhookSignature(secret string, timestamp string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(SignWebhookPayload(secret, timestamp, body)), []byte(signature))
+}
+
+// WebhookDispatcher posts ticks and triggered alerts to the registered webhooks,
+// retrying failures and recording the payloads that never got through
+type WebhookDispatcher struct {
+	// Store is shared by every replica and is the record of the webhooks
+	Store  WebhookStore
+	Client *http.Client
+	// MaxAttempts is how often a payload is posted before it is dead-lettered
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	// MaxWebhooks limits the webhooks of each client; zero means unlimited
+	MaxWebhooks int
+	// Workers deliver payloads in parallel
+	Workers int
+	// AllowPrivateNetworks lets webhooks reach loopback, link-local and private addresses, which are refused by default
+	AllowPrivateNetworks bool
+
+	mu sync.Mutex
+	// The webhooks as last read from the store, which the ticks and alerts are matched against
+	webhooks map[string]*Webhook
+	loaded   time.Time
+	queue    chan *WebhookDelivery
+}
+
+// Create a new dispatcher, loading the stored webhooks
+func NewWebhookDispatcher(ctx context.Context, store WebhookStore) (*WebhookDispatcher, error) {
+	webhooks, err := store.LoadWebhooks(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load webhooks: %v", err)
+	}
+
+	d := &WebhookDispatcher{
+		Store:       store,
+		MaxAttempts: 5,
+		BaseDelay:   time.Second,
+		MaxDelay:    time.Minute,
+		MaxWebhooks: defaultMaxWebhooks,
+		Workers:     4,
+		queue:       make(chan *WebhookDelivery, webhookQueueSize),
+	}
+	d.Client = &http.Client{Timeout: 5 * time.Second, Transport: d.transport()}
+	d.setWebhooks(webhooks)
+	return d, nil
+}
+
+// A transport that only connects to the addresses webhooks may reach. The address is checked
+// as it is dialed, so a host resolving to another address since it was registered is refused too.
+func (d *WebhookDispatcher) transport() *http.Transport {
+	dialer := &net.Dialer{
+		Timeout: 5 * time.Second,
+		Control: func(network string, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			return d.checkAddress(net.ParseIP(host))
+		},
+	}
+	// No proxy, which would be dialed in place of the webhook
+	return &http.Transport{
+		DialContext:         dialer.DialContext,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+}
+
+// Refuse loopback, link-local, private and unspecified addresses unless private networks are allowed
+func (d *WebhookDispatcher) checkAddress(ip net.IP) error {
+	if d.AllowPrivateNetworks {
+		return nil
+	}
+	if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() {
+		return fmt.Errorf("address %v is not public", ip)
+	}
+	return nil
+}
+
+// Resolve the host of a webhook URL and refuse it if any of its addresses may not be reached
+func (d *WebhookDispatcher) checkURL(ctx context.Context, rawURL string) error {
+	if d.AllowPrivateNetworks {
+		return nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return invalidArgument([]*errdetails.BadRequest_FieldViolation{{Field: "url", Description: "must be an absolute http or https URL"}})
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		return invalidArgument([]*errdetails.BadRequest_FieldViolation{{Field: "url", Description: fmt.Sprintf("host %q cannot be resolved", u.Hostname())}})
+	}
+	for _, addr := range addrs {
+		if err := d.checkAddress(addr.IP); err != nil {
+			return invalidArgument([]*errdetails.BadRequest_FieldViolation{{Field: "url", Description: "must not resolve to a loopback, link-local or private address"}})
+		}
+	}
+	return nil
+}
+
+// Create a dispatcher storing webhooks in Redis, configured from WEBHOOK_TIMEOUT, WEBHOOK_MAX_ATTEMPTS,
+// WEBHOOK_WORKERS, MAX_WEBHOOKS_PER_CLIENT and WEBHOOK_ALLOW_PRIVATE_NETWORKS
+func NewWebhookDispatcherFromEnv(ctx context.Context) (*WebhookDispatcher, error) {
+	d, err := NewWebhookDispatcher(ctx, &RedisWebhookStore{RedisClient: NewRedisClient()})
+	if err != nil {
+		return nil, err
+	}
+	d.Client.Timeout = envDuration("WEBHOOK_TIMEOUT", 5*time.Second)
+	d.MaxAttempts = envInt("WEBHOOK_MAX_ATTEMPTS", 5)
+	d.MaxWebhooks = envInt("MAX_WEBHOOKS_PER_CLIENT", defaultMaxWebhooks)
+	d.Workers = envInt("WEBHOOK_WORKERS", 4)
+	d.AllowPrivateNetworks = os.Getenv("WEBHOOK_ALLOW_PRIVATE_NETWORKS") == "true"
+	return d, nil
+}
+
+// Deliver the queued payloads until the context is done
+func (d *WebhookDispatcher) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < d.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case delivery := <-d.queue:
+					d.deliver(ctx, delivery)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Register a webhook, generating its secret unless one is given
+func (d *WebhookDispatcher) Create(ctx context.Context, webhook *Webhook) (*Webhook, error) {
+	if err := d.checkURL(ctx, webhook.URL); err != nil {
+		return nil, err
+	}
+	webhook.ID = newSubscriptionID()
+	webhook.CreatedAt = time.Now().UTC()
+	if webhook.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, Internal("create webhook", err)
+		}
+		webhook.Secret = hex.EncodeToString(secret)
+	}
+
+	if d.MaxWebhooks > 0 {
+		owned, err := d.List(ctx, webhook.Owner)
+		if err != nil {
+			return nil, err
+		}
+		if len(owned) >= d.MaxWebhooks {
+			return nil, status.Errorf(codes.ResourceExhausted, "webhook limit of %d reached", d.MaxWebhooks)
+		}
+	}
+	if err := d.Store.SaveWebhook(ctx, webhook); err != nil {
+		return nil, err
+	}
+
+	// The other replicas see the webhook on their next refresh
+	d.mu.Lock()
+	d.webhooks[webhook.ID] = webhook
+	d.mu.Unlock()
+	copied := *webhook
+	return &copied, nil
+}
+
+// List the stored webhooks of the owner, oldest first
+func (d *WebhookDispatcher) List(ctx context.Context, owner string) ([]*Webhook, error) {
+	stored, err := d.Store.LoadWebhooks(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var webhooks []*Webhook
+	for _, webhook := range stored {
+		if webhook.Owner == owner {
+			webhooks = append(webhooks, webhook)
+		}
+	}
+	sort.Slice(webhooks, func(i, j int) bool { return webhooks[i].CreatedAt.Before(webhooks[j].CreatedAt) })
+	return webhooks, nil
+}
+
+// Look up a stored webhook of the owner
+func (d *WebhookDispatcher) owned(ctx context.Context, owner string, id string) (*Webhook, error) {
+	webhook, err := d.Store.LoadWebhook(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if webhook == nil || webhook.Owner != owner {
+		return nil, nil
+	}
+	return webhook, nil
+}
+
+// Delete a webhook of the owner and its dead letters
+func (d *WebhookDispatcher) Delete(ctx context.Context, owner string, id string) error {
+	webhook, err := d.owned(ctx, owner, id)
+	if err != nil {
+		return err
+	}
+	if webhook == nil {
+		return NotFound("delete webhook", fmt.Errorf("no webhook with id %q", id))
+	}
+	if err := d.Store.DeleteWebhook(ctx, id); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	delete(d.webhooks, id)
+	d.mu.Unlock()
+	return nil
+}
+
+// Replace the webhooks matched with those read from the store
+func (d *WebhookDispatcher) setWebhooks(webhooks []*Webhook) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.webhooks = make(map[string]*Webhook, len(webhooks))
+	for _, webhook := range webhooks {
+		d.webhooks[webhook.ID] = webhook
+	}
+	d.loaded = time.Now()
+}
+
+// Read the webhooks from the store again when the copy matched is older than alertRefresh,
+// keeping the copy when the store cannot be read
+func (d *WebhookDispatcher) refresh(ctx context.Context) {
+	d.mu.Lock()
+	fresh := time.Since(d.loaded) < alertRefresh
+	d.mu.Unlock()
+	if fresh {
+		return
+	}
+
+	webhooks, err := d.Store.LoadWebhooks(ctx)
+	if err != nil {
+		loggerFromContext(ctx).Warn("failed to reload webhooks", "error", err)
+		return
+	}
+	d.setWebhooks(webhooks)
+}
+
+// The number of payloads in the dead-letter record of the webhook
+func (d *WebhookDispatcher) DeadLetters(ctx context.Context, id string) (int, error) {
+	return d.Store.CountDeadLetters(ctx, id)
+}
+
+// Queue a published price for the webhooks that want it
+func (d *WebhookDispatcher) PublishTick(ctx context.Context, asset string, currency string, price float64, at time.Time) {
+	d.refresh(ctx)
+	d.mu.Lock()
+	var targets []*Webhook
+	for _, webhook := range d.webhooks {
+		if webhook.matches(pricepb.WebhookEvent_WEBHOOK_EVENT_TICK, asset, currency) {
+			targets = append(targets, webhook)
+		}
+	}
+	d.mu.Unlock()
+
+	for _, webhook := range targets {
+		d.enqueue(ctx, webhook, &WebhookPayload{Type: "tick", Asset: asset, Currency: currency, Price: price, Timedate: at})
+	}
+}
+
+// Queue a triggered alert for the webhooks of its owner that want it
+func (d *WebhookDispatcher) PublishAlert(ctx context.Context, event *AlertEvent) {
+	alert := event.Alert
+
+	d.refresh(ctx)
+	d.mu.Lock()
+	var targets []*Webhook
+	for _, webhook := range d.webhooks {
+		if webhook.Owner == alert.Owner && webhook.matches(pricepb.WebhookEvent_WEBHOOK_EVENT_ALERT, alert.Asset, alert.Currency) {
+			targets = append(targets, webhook)
+		}
+	}
+	d.mu.Unlock()
+
+	for _, webhook := range targets {
+		d.enqueue(ctx, webhook, &WebhookPayload{
+			Type:     "alert",
+			Asset:    alert.Asset,
+			Currency: alert.Currency,
+			Price:    event.Price,
+			Timedate: event.Time,
+			Alert: &WebhookAlert{
+				ID:            alert.ID,
+				Condition:     alert.Condition.String(),
+				Threshold:     alert.Threshold,
+				Percent:       alert.Percent,
+				WindowMinutes: alert.WindowMinutes,
+				ChangePercent: event.ChangePercent,
+			},
+		})
+	}
+}
+
+// Queue the payload for delivery, dead-lettering it when the queue is full
+func (d *WebhookDispatcher) enqueue(ctx context.Context, webhook *Webhook, payload *WebhookPayload) {
+	payload.ID = newSubscriptionID()
+	body, err := json.Marshal(payload)
+	if err != nil {
+		loggerFromContext(ctx).Error("failed to marshal webhook payload", "error", err)
+		return
+	}
+
+	delivery := &WebhookDelivery{ID: payload.ID, WebhookID: webhook.ID, Payload: body}
+	select {
+	case d.queue <- delivery:
+	default:
+		delivery.LastError = "delivery queue is full"
+		d.deadLetter(ctx, delivery)
+	}
+}
+
+// Post the payload, retrying with backoff, and dead-letter it when every attempt failed
+func (d *WebhookDispatcher) deliver(ctx context.Context, delivery *WebhookDelivery) {
+	logger := loggerFromContext(ctx).With("webhook_id", delivery.WebhookID, "delivery_id", delivery.ID)
+
+	for attempt := 0; attempt < d.MaxAttempts; attempt++ {
+		if attempt > 0 {
+			webhookDeliveries.WithLabelValues("retried").Inc()
+			select {
+			case <-time.After(jitteredBackoff(d.BaseDelay, d.MaxDelay, attempt)):
+			case <-ctx.Done():
+				d.deadLetter(ctx, delivery)
+				return
+			}
+		}
+
+		err := d.send(ctx, delivery)
+		if err == nil {
+			webhookDeliveries.WithLabelValues("delivered").Inc()
+			return
+		}
+		if errors.Is(err, errWebhookDeleted) {
+			return
+		}
+		logger.Warn("webhook delivery failed", "attempt", delivery.Attempts, "error", err)
+		if errors.As(err, &errPermanent{}) {
+			break
+		}
+	}
+	d.deadLetter(ctx, delivery)
+}
+
+var errWebhookDeleted = errors.New("webhook was deleted")
+
+// Make a single signed request to the webhook, as stored now
+func (d *WebhookDispatcher) send(ctx context.Context, delivery *WebhookDelivery) error {
+	webhook, err := d.Store.LoadWebhook(ctx, delivery.WebhookID)
+	if err != nil {
+		delivery.LastError = err.Error()
+		return err
+	}
+	if webhook == nil {
+		return errWebhookDeleted
+	}
+
+	delivery.Attempts++
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		delivery.LastError = err.Error()
+		return errPermanent{err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookIDHeader, delivery.ID)
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookSignatureHeader, SignWebhookPayload(webhook.Secret, timestamp, delivery.Payload))
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		delivery.LastError = err.Error()
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		err := fmt.Errorf("webhook returned %s", resp.Status)
+		delivery.LastError = err.Error()
+		// Server errors, timeouts and throttling are worth retrying, other client errors are not
+		if resp.StatusCode < 500 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+			return errPermanent{err}
+		}
+		return err
+	}
+	return nil
+}
+
+// Record a payload that could not be delivered
+func (d *WebhookDispatcher) deadLetter(ctx context.Context, delivery *WebhookDelivery) {
+	webhookDeliveries.WithLabelValues("dead_lettered").Inc()
+	delivery.FailedAt = time.Now().UTC()
+	// The delivery may have been abandoned because the context is done, the record must still be written
+	if err := d.Store.SaveDeadLetter(context.WithoutCancel(ctx), delivery); err != nil {
+		loggerFromContext(ctx).Error("failed to record undelivered webhook payload", "webhook_id", delivery.WebhookID, "error", err)
+	}
+}
+
+// Redeliver the dead letters of a webhook of the owner once each.
+// The payloads that fail again go back to the dead-letter record.
+func (d *WebhookDispatcher) Replay(ctx context.Context, owner string, id string) (delivered int, failed int, err error) {
+	webhook, err := d.owned(ctx, owner, id)
+	if err != nil {
+		return 0, 0, err
+	}
+	if webhook == nil {
+		return 0, 0, NotFound("replay webhook", fmt.Errorf("no webhook with id %q", id))
+	}
+
+	deliveries, err := d.Store.TakeDeadLetters(ctx, id)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, delivery := range deliveries {
+		if err := d.send(ctx, delivery); err != nil {
+			failed++
+			d.deadLetter(ctx, delivery)
+			continue
+		}
+		webhookDeliveries.WithLabelValues("delivered").Inc()
+		delivered++
+	}
+	loggerFromContext(ctx).Info("replayed webhook dead letters", "webhook_id", id, "delivered", delivered, "failed", failed)
+	return delivered, failed, nil
+}
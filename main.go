@@ -1,29 +1,255 @@
 package main
 
 import (
-	"log"
+	"context"
+	"crypto/tls"
+	"log/slog"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"BTCPrice/Server"
 
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 
 	pricepb "BTCPrice/protofiles"
 )
 
 func main() {
+	slog.SetDefault(Server.NewLogger(os.Stdout))
+
+	shutdownTracer, err := Server.InitTracer(context.Background())
+	if err != nil {
+		slog.Error("failed to initialize tracing", "error", err)
+		os.Exit(1)
+	}
+	defer shutdownTracer(context.Background())
+
 	lis, err := net.Listen("tcp", "0.0.0.0:50051")
 	if err != nil {
-		log.Fatalf("Failed to listen: %v", err)
+		slog.Error("failed to listen", "error", err)
+		os.Exit(1)
+	}
+
+	validator, err := Server.NewValidatorFromEnv()
+	if err != nil {
+		slog.Error("failed to configure validation", "error", err)
+		os.Exit(1)
+	}
+
+	backpressure, err := Server.BackpressureConfigFromEnv()
+	if err != nil {
+		slog.Error("failed to configure backpressure", "error", err)
+		os.Exit(1)
+	}
+
+	broker, err := Server.DefaultBroker()
+	if err != nil {
+		slog.Error("failed to configure the message broker", "error", err)
+		os.Exit(1)
 	}
+	defer broker.Close()
 
 	// An instance of server
-	server := &Server.Server{}
+	server := &Server.Server{Validator: validator, Backpressure: backpressure, Broker: broker}
+
+	if path := os.Getenv("POLICY_FILE"); path != "" {
+		server.Authorizer, err = Server.LoadAuthorizer(path)
+		if err != nil {
+			slog.Error("failed to load policy", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if os.Getenv("ALERTS_DISABLED") != "true" {
+		server.Alerts, err = Server.NewAlertEngineFromEnv(context.Background())
+		if err != nil {
+			slog.Error("failed to load alerts", "error", err)
+			os.Exit(1)
+		}
+		// The leader evaluates the alerts, every replica serves the watchers of its clients
+		server.Alerts.Broker = broker
+		go server.Alerts.Run(context.Background())
+	}
+
+	if os.Getenv("WEBHOOKS_DISABLED") != "true" {
+		server.Webhooks, err = Server.NewWebhookDispatcherFromEnv(context.Background())
+		if err != nil {
+			slog.Error("failed to load webhooks", "error", err)
+			os.Exit(1)
+		}
+		go server.Webhooks.Run(context.Background())
+		if server.Alerts != nil {
+			server.Alerts.OnTrigger(server.Webhooks.PublishAlert)
+		}
+	}
+
+	// On shutdown the leader steps down before the server stops, so another replica takes over at once
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	poller, err := server.NewPoller()
+	if err != nil {
+		slog.Error("failed to create the price poller", "error", err)
+		os.Exit(1)
+	}
+	defer poller.Close()
+	polled := make(chan struct{})
+	go func() {
+		defer close(polled)
+		runPoller(ctx, poller, broker)
+	}()
+
+	// The stats handler extracts the trace context from incoming gRPC metadata
+	opts := []grpc.ServerOption{grpc.StatsHandler(otelgrpc.NewServerHandler())}
+
+	reloader, err := Server.CertReloaderFromEnv()
+	if err != nil {
+		slog.Error("failed to configure TLS", "error", err)
+		os.Exit(1)
+	}
+	if reloader != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(reloader.TLSConfig())))
+		go reloadCertificatesOnHangup(reloader)
+	} else {
+		slog.Warn("TLS is disabled")
+	}
+
+	auth, err := Server.NewAuthenticatorFromEnv()
+	if err != nil {
+		slog.Error("failed to configure authentication", "error", err)
+		os.Exit(1)
+	}
+	var streamInterceptors []grpc.StreamServerInterceptor
+	var unaryInterceptors []grpc.UnaryServerInterceptor
+	if auth != nil {
+		streamInterceptors = append(streamInterceptors, Server.StreamAuthInterceptor(auth))
+		unaryInterceptors = append(unaryInterceptors, Server.UnaryAuthInterceptor(auth))
+	} else {
+		slog.Warn("authentication is disabled")
+	}
+
+	// Rate limits run after authentication so clients are keyed by principal where possible
+	limiter := Server.NewRateLimiter(Server.RateLimitConfigFromEnv())
+	streamInterceptors = append(streamInterceptors, Server.StreamRateLimitInterceptor(limiter))
+	unaryInterceptors = append(unaryInterceptors, Server.UnaryRateLimitInterceptor(limiter, pricepb.PriceService_ReplayWebhook_FullMethodName))
 
-	s := grpc.NewServer()
+	opts = append(opts,
+		grpc.ChainStreamInterceptor(streamInterceptors...),
+		grpc.ChainUnaryInterceptor(unaryInterceptors...),
+	)
+
+	s := grpc.NewServer(opts...)
 	pricepb.RegisterPriceServiceServer(s, server)
 
+	// Report each price source as not serving while its circuit breaker is open
+	healthServer := health.NewServer()
+	healthpb.RegisterHealthServer(s, healthServer)
+	for _, asset := range validator.Assets() {
+		source, _ := Server.PriceSourceFor(asset)
+		healthServer.SetServingStatus(source.Name, healthpb.HealthCheckResponse_SERVING)
+		source.Breaker.OnStateChange(func(state Server.BreakerState) {
+			slog.Warn("price source circuit breaker changed state", "source", source.Name, "state", state.String())
+			if state == Server.BreakerOpen {
+				healthServer.SetServingStatus(source.Name, healthpb.HealthCheckResponse_NOT_SERVING)
+			} else {
+				healthServer.SetServingStatus(source.Name, healthpb.HealthCheckResponse_SERVING)
+			}
+		})
+	}
+
+	gateway, err := Server.NewGateway(server, auth, limiter)
+	if err != nil {
+		slog.Error("failed to create the HTTP gateway", "error", err)
+		os.Exit(1)
+	}
+	go serveGateway(gateway, reloader)
+
+	go serveMetrics()
+
+	go func() {
+		<-ctx.Done()
+		<-polled
+		slog.Info("shutting down")
+		s.Stop()
+	}()
+
+	slog.Info("server listening", "address", lis.Addr().String())
 	if err := s.Serve(lis); err != nil {
-		log.Fatalf("Failed to serve: %v", err)
+		slog.Error("failed to serve", "error", err)
+		os.Exit(1)
+	}
+}
+
+// Poll the price sources while this replica is the leader, or always when LEADER_ELECTION
+// is false or the broker does not leave the process
+func runPoller(ctx context.Context, poller *Server.Poller, broker Server.Broker) {
+	if _, inProcess := broker.(*Server.MemoryBroker); inProcess || os.Getenv("LEADER_ELECTION") == "false" {
+		slog.Info("polling the price sources without leader election")
+		poller.Run(ctx, 0)
+		return
+	}
+
+	client := Server.NewRedisClient()
+	defer client.Close()
+	elector := Server.NewLeaderElectorFromEnv(client)
+	poller.FenceKey = elector.TokenKey()
+	elector.Run(ctx, poller.Run)
+}
+
+// Reload the TLS certificates when the process receives SIGHUP
+func reloadCertificatesOnHangup(reloader *Server.CertReloader) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := reloader.Reload(); err != nil {
+			slog.Error("failed to reload TLS certificates", "error", err)
+			continue
+		}
+		slog.Info("reloaded TLS certificates")
+	}
+}
+
+// Serve the Prometheus metrics on METRICS_ADDR
+func serveMetrics() {
+	addr := os.Getenv("METRICS_ADDR")
+	if addr == "" {
+		addr = ":9090" // default value
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Server.MetricsHandler())
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		slog.Error("failed to serve metrics", "error", err)
+	}
+}
+
+// Serve the HTTP/JSON gateway, over TLS when gRPC is
+func serveGateway(gateway *Server.Gateway, reloader *Server.CertReloader) {
+	addr := os.Getenv("HTTP_ADDR")
+	if addr == "" {
+		addr = ":8080" // default value
+	}
+
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		slog.Error("failed to listen for HTTP", "error", err)
+		return
+	}
+	if reloader != nil {
+		lis = tls.NewListener(lis, reloader.TLSConfig())
+	}
+
+	httpServer := &http.Server{Handler: gateway.Handler(), ReadHeaderTimeout: 10 * time.Second}
+	slog.Info("HTTP gateway listening", "address", lis.Addr().String())
+	if err := httpServer.Serve(lis); err != nil {
+		slog.Error("failed to serve HTTP", "error", err)
 	}
 }